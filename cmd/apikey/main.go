@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
+)
+
+const usage = `Manage the API keys of the API.
+
+Usage:
+  apikey [config flags] issue <name> [role...]   create a key and print it once
+  apikey [config flags] revoke <id>              disable a key
+  apikey [config flags] list                     show every key and when it was last used
+
+Roles are reader, librarian and admin. Keys are issued as reader by default,
+write access has to be asked for, e.g.:
+
+  apikey issue importer librarian
+`
+
+func main() {
+	// The port is not used, but the shared configuration validates it
+	cfg, err := config.Load("apikey", 8080, os.Args[1:])
+	if err != nil {
+		internal.Fatal("Invalid configuration", err)
+	}
+	if len(cfg.Args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
+	}
+	defer cancel()
+	defer client.Disconnect(ctx)
+
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.QueryTimeout)
+	defer cancel()
+
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+
+	switch cmd, args := cfg.Args[0], cfg.Args[1:]; {
+	case cmd == "issue" && len(args) >= 1:
+		roles, err := internal.ParseRoles(args[1:])
+		if err != nil {
+			internal.Fatal("Invalid role", err)
+		}
+		key, apiKey, err := internal.IssueAPIKey(ctx, keys, args[0], roles)
+		if err != nil {
+			internal.Fatal("Failed to issue API key", err)
+		}
+		fmt.Printf("Issued key %s (%s, %s). It will not be shown again:\n%s\n", apiKey.ID, apiKey.Name, formatRoles(apiKey.Roles), key)
+
+	case cmd == "revoke" && len(args) == 1:
+		if err := internal.RevokeAPIKey(ctx, keys, args[0]); err != nil {
+			internal.Fatal("Failed to revoke API key", err)
+		}
+		fmt.Printf("Revoked key %s\n", args[0])
+
+	case cmd == "list" && len(args) == 0:
+		list, err := internal.ListAPIKeys(ctx, keys)
+		if err != nil {
+			internal.Fatal("Failed to list API keys", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tROLES\tCREATED\tLAST USED\tREVOKED")
+		for _, k := range list {
+			roles := k.Roles
+			if len(roles) == 0 {
+				roles = internal.DefaultAPIKeyRoles
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, formatRoles(roles), formatTime(&k.CreatedAt), formatTime(k.LastUsedAt), formatTime(k.RevokedAt))
+		}
+		w.Flush()
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func formatRoles(roles []internal.Role) string {
+	names := make([]string, len(roles))
+	for i, r := range roles {
+		names[i] = string(r)
+	}
+	return strings.Join(names, ",")
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
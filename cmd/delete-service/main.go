@@ -2,46 +2,155 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"os"
 
 	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
 
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	client, ctx, cancel, err := internal.ConnectDB()
+	cfg, err := config.Load("delete-service", 8082, os.Args[1:])
 	if err != nil {
-		panic(err)
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("delete-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "delete-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
 	}
 	defer cancel()
 	defer client.Disconnect(ctx)
 
-	coll, err := internal.PrepareDatabase(client, "exercise-1", "information")
+	coll, err := internal.PrepareDatabase(client, cfg.Database, cfg.Collection)
 	if err != nil {
-		panic(err)
+		internal.Fatal("Error preparing database", err)
+	}
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
 	}
-	internal.PrepareData(client, coll)
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
 
-	e := echo.New()
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	audit, err := internal.PrepareAudit(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing audit log", err)
+	}
+	revisions, err := internal.PrepareRevisions(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing revisions", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+	circ, err := internal.PrepareCirculation(ctx, client.Database(cfg.Database), coll, outbox, internal.CirculationPolicy{
+		LoanPeriod: cfg.LoanPeriod,
+		HoldPeriod: cfg.HoldPeriod,
+		MaxLoans:   cfg.MaxLoans,
+		FinePerDay: cfg.FinePerDay,
+	})
+	if err != nil {
+		internal.Fatal("Error preparing loans", err)
+	}
+	reviews, err := internal.PrepareReviews(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing reviews", err)
+	}
 
-	e.DELETE("/api/books/:id", func(c echo.Context) error {
+	// Deleted books are kept in the trash for TRASH_RETENTION, then removed
+	// for good by this service
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	defer stopPurge()
+	internal.StartPurger(purgeCtx, coll, revisions, audit, circ.Holds, reviews, cfg.TrashRetention, cfg.QueryTimeout)
+
+	e := internal.NewServer("delete-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
+
+	// Requests are authenticated with an API key (see cmd/apikey) or an
+	// access token issued by the frontend, verified locally with the shared
+	// secret or the frontend's JWKS. Each route then checks the caller's role.
+	// Writes are limited more strictly than reads (WRITE_RATE_LIMIT).
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+	limiter := internal.NewRateLimiter(cfg.WriteRateLimit)
+	// Every IP address is limited before its credentials are checked
+	ipLimiter := internal.NewRateLimiter(cfg.IPRateLimit)
+	api := e.Group("/api", ipLimiter.IPMiddleware(), auth.Authenticate, limiter.Middleware())
+
+	api.DELETE("/books/:id", func(c echo.Context) error {
 		id := c.Param("id")
 
-		// Delete the book from the database
-		filter := bson.M{"id": id}
-		result, err := coll.DeleteOne(context.TODO(), filter)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		// Move the book to the trash, it can be restored until it is purged
+		err := internal.TrashBook(ctx, coll, audit, outbox, internal.RequestActor(c), id)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return c.JSON(http.StatusOK, map[string]string{"message": "Book not found"})
+		}
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete book"})
+			return internal.DBError(c, err, "Failed to delete book")
 		}
-		if result.DeletedCount == 0 {
-			return c.JSON(http.StatusOK, map[string]string{"message": "Book not found"})
 
+		return c.JSON(http.StatusOK, map[string]string{"message": "Book deleted successfully"})
+	}, internal.RequireRole(internal.RoleAdmin))
+
+	// Cancels a hold. Readers cancel their own holds, librarians any. A copy
+	// kept for the hold goes to the next one in the queue.
+	api.DELETE("/holds/:id", func(c echo.Context) error {
+		borrower, ok := internal.ActingBorrower(c, "")
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Sign in to cancel holds"})
+		}
+		if internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian) {
+			borrower = ""
 		}
 
-		return c.JSON(http.StatusOK, map[string]string{"message": "Book deleted successfully"})
-	})
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		hold, err := circ.CancelHold(ctx, c.Param("id"), borrower)
+		if errors.Is(err, internal.ErrHoldNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Hold not found"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to cancel hold")
+		}
+		return c.JSON(http.StatusOK, hold)
+	}, internal.RequireRole(internal.RoleReader))
+
+	// Removes a member without open loans and cancels their holds
+	api.DELETE("/members/:id", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		err := circ.DeleteMember(ctx, c.Param("id"))
+		switch {
+		case errors.Is(err, internal.ErrMemberNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		case errors.Is(err, internal.ErrMemberHasLoans):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Member has open loans"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to delete member")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Member deleted successfully"})
+	}, internal.RequireRole(internal.RoleAdmin))
 
-	e.Logger.Fatal(e.Start(":8082"))
+	internal.Start(e, cfg.Addr())
 }
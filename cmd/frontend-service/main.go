@@ -1,54 +1,345 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
 
 	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	client, ctx, cancel, err := internal.ConnectDB()
+	cfg, err := config.Load("frontend-service", 8080, os.Args[1:])
 	if err != nil {
-		log.Fatalf("Failed to connect to DB: %v", err)
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("frontend-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "frontend-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
 	}
 	defer cancel()
 	defer client.Disconnect(ctx)
 
-	coll, err := internal.PrepareDatabase(client, "exercise-1", "information")
+	coll, err := internal.PrepareDatabase(client, cfg.Database, cfg.Collection)
+	if err != nil {
+		internal.Fatal("Error preparing database", err)
+	}
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
+	}
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
+
+	users, err := internal.PrepareUsers(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing users", err)
+	}
+	sessions, err := internal.NewSessionStore(ctx, client.Database(cfg.Database), cfg.SessionTTL, cfg.CookieSecure, cfg.QueryTimeout)
+	if err != nil {
+		internal.Fatal("Error preparing sessions", err)
+	}
+	audit, err := internal.PrepareAudit(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing audit log", err)
+	}
+	revisions, err := internal.PrepareRevisions(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing revisions", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+	reviews, err := internal.PrepareReviews(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing reviews", err)
+	}
+	signer, err := internal.NewTokenSigner(cfg.JWTSecret, cfg.JWTKeyFiles, cfg.TokenTTL)
 	if err != nil {
-		log.Fatalf("Error preparing database: %v", err)
+		internal.Fatal("Error loading token signing keys", err)
 	}
-	internal.PrepareData(client, coll)
 
-	e := echo.New()
+	// Changes of the catalog, no matter which service made them
+	feedCtx, stopFeed := context.WithCancel(context.Background())
+	defer stopFeed()
+	events := internal.StartChangeFeed(feedCtx, coll)
+
+	e := internal.NewServer("frontend-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
+	// Event streams never end on their own, close them when shutting down
+	e.Server.RegisterOnShutdown(stopFeed)
 
 	// Set the renderer for HTML templates
 	e.Renderer = internal.LoadTemplates()
 
-	// Serve static assets like CSS
+	// Serve static assets like CSS and the self-hosted htmx
 	e.Static("/css", "css")
+	if err := internal.CheckScripts("js"); err != nil {
+		internal.Fatal("Missing self-hosted scripts", err)
+	}
+	e.Static("/js", "js")
+
+	// Lock the pages down to resources of the frontend and require the CSRF
+	// token on every form and htmx request that changes state
+	e.Use(internal.SecurityHeaders())
+	e.Use(internal.CSRF(cfg.CookieSecure))
+
+	// Resolve the signed-in user and their roles on every page request
+	e.Use(sessions.Middleware())
 
 	// Routes serving HTML pages
 
 	e.GET("/", func(c echo.Context) error {
-		return c.Render(200, "index", nil)
+		return c.Render(200, "index", map[string]interface{}{
+			"User": internal.CurrentUser(c),
+			"CSRF": internal.CSRFToken(c),
+			// Only offer the actions the API would accept
+			"CanCreate": internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian),
+		})
 	})
 
 	e.GET("/books", func(c echo.Context) error {
-		books := internal.FindAllBooks(coll)
-		return c.Render(200, "book-table", books)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		books, err := internal.FindAllBooks(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve books")
+		}
+		canEdit := internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian)
+		return c.Render(200, "book-table", map[string]interface{}{
+			"Rows":    internal.BookRows(books, canEdit),
+			"CanEdit": canEdit,
+			"Live":    true,
+		})
+	})
+
+	// Server-Sent Events keeping the book table up to date. Every change is
+	// sent as a "book" event carrying the rows to swap in (see "book-event"
+	// in index.html).
+	e.GET("/events", func(c echo.Context) error {
+		canEdit := internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian)
+		changes, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		w := c.Response()
+		w.Header().Set(echo.HeaderContentType, "text/event-stream")
+		w.Header().Set(echo.HeaderCacheControl, "no-cache")
+		// Tell nginx to pass the events on as they come
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		w.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-feedCtx.Done():
+				return nil
+			case <-heartbeat.C:
+				// Comments keep proxies from closing the idle connection
+				fmt.Fprint(w, ": ping\n\n")
+				w.Flush()
+			case ev := <-changes:
+				// Updated rows replace the existing row, created ones are
+				// appended by the <tbody> wrapping them
+				row := internal.BookRow{CanEdit: canEdit}
+				if ev.Type == internal.BookUpdated {
+					row.SwapOOB = "true"
+				}
+				if ev.Book != nil {
+					row.Book = internal.BookFields(*ev.Book)
+				}
+				var html bytes.Buffer
+				err := c.Echo().Renderer.Render(&html, "book-event", map[string]interface{}{
+					"Type":   ev.Type,
+					"BookID": ev.BookID,
+					"Row":    row,
+				}, c)
+				if err != nil {
+					return err
+				}
+				writeEvent(w, "book", html.String())
+				w.Flush()
+			}
+		}
+	})
+
+	// History panel of a book, listing its previous versions with a button
+	// to restore each of them
+	history := func(c echo.Context, ctx context.Context, id string) error {
+		list, err := internal.ListRevisions(ctx, revisions, id)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve history")
+		}
+		return c.Render(200, "history", map[string]interface{}{
+			"BookID":    id,
+			"Revisions": list,
+		})
+	}
+
+	e.GET("/books/:id/history", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		return history(c, ctx, c.Param("id"))
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	e.POST("/books/:id/revert/:rev", func(c echo.Context) error {
+		id := c.Param("id")
+		rev, err := strconv.Atoi(c.Param("rev"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid revision")
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		err = internal.RevertBook(ctx, coll, revisions, audit, outbox, internal.RequestActor(c), id, rev)
+		if errors.Is(err, mongo.ErrNoDocuments) || errors.Is(err, internal.ErrRevisionNotFound) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to revert book")
+		}
+		return history(c, ctx, id)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Reviews panel of a book: its approved reviews, a form for signed-in
+	// readers and, for librarians, the reviews awaiting moderation. status
+	// is 422 when the panel shows an error of the form.
+	reviewsPanel := func(c echo.Context, ctx context.Context, id string, status int, data map[string]interface{}) error {
+		var book internal.BookStore
+		err := coll.FindOne(ctx, internal.NotDeleted(bson.M{"id": id})).Decode(&book)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return c.String(http.StatusNotFound, "Book not found")
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve book")
+		}
+		approved, err := internal.ListReviews(ctx, reviews, internal.ReviewFilter{BookID: id, Status: internal.ReviewApproved})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve reviews")
+		}
+		canModerate := internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian)
+		var pending []internal.Review
+		if canModerate {
+			pending, err = internal.ListReviews(ctx, reviews, internal.ReviewFilter{BookID: id, Status: internal.ReviewPending})
+			if err != nil {
+				return internal.DBError(c, err, "Failed to retrieve reviews")
+			}
+		}
+
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		data["Book"] = internal.BookFields(book)
+		data["Reviews"] = approved
+		data["Pending"] = pending
+		data["CanReview"] = internal.CurrentUser(c) != ""
+		data["CanModerate"] = canModerate
+		return c.Render(status, "reviews", data)
+	}
+
+	e.GET("/books/:id/reviews", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		return reviewsPanel(c, ctx, c.Param("id"), http.StatusOK, nil)
 	})
 
+	e.POST("/books/:id/reviews", func(c echo.Context) error {
+		user := internal.CurrentUser(c)
+		if user == "" {
+			return c.String(http.StatusUnauthorized, "Sign in to review books")
+		}
+		id := c.Param("id")
+		rating, _ := strconv.Atoi(c.FormValue("rating"))
+		text := c.FormValue("text")
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		_, err := internal.AddReview(ctx, coll, reviews, id, user, rating, text)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.String(http.StatusNotFound, "Book not found")
+		case errors.Is(err, internal.ErrInvalidReview):
+			return reviewsPanel(c, ctx, id, http.StatusUnprocessableEntity, map[string]interface{}{
+				"Error": "Please rate the book from 1 to 5 and keep the review under 5000 characters.",
+				"Text":  text,
+			})
+		case errors.Is(err, internal.ErrReviewExists):
+			return reviewsPanel(c, ctx, id, http.StatusUnprocessableEntity, map[string]interface{}{
+				"Error": "You already reviewed this book.",
+			})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to save review")
+		}
+		return reviewsPanel(c, ctx, id, http.StatusOK, map[string]interface{}{
+			"Notice": "Thank you! Your review is shown once it has been approved.",
+		})
+	}, internal.RequireRole(internal.RoleReader))
+
+	// Approves or rejects a review, status is "approved" or "rejected"
+	e.POST("/reviews/:id/:status", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		review, err := internal.ModerateReview(ctx, coll, reviews, outbox, internal.RequestActor(c), c.Param("id"), c.Param("status"))
+		switch {
+		case errors.Is(err, internal.ErrInvalidReview):
+			return c.String(http.StatusBadRequest, err.Error())
+		case errors.Is(err, internal.ErrReviewNotFound):
+			return c.String(http.StatusNotFound, "Review not found")
+		case err != nil:
+			return internal.DBError(c, err, "Failed to moderate review")
+		}
+		return reviewsPanel(c, ctx, review.BookID, http.StatusOK, nil)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
 	e.GET("/authors", func(c echo.Context) error {
-		authors := internal.FindAllAuthors(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		authors, err := internal.FindAllAuthors(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve authors")
+		}
 		return c.Render(200, "authors", authors)
 	})
 
 	e.GET("/years", func(c echo.Context) error {
-		years := internal.FindAllYears(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		years, err := internal.FindAllYears(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve years")
+		}
 		return c.Render(200, "years", years)
 	})
 
@@ -58,8 +349,147 @@ func main() {
 
 	e.GET("/create", func(c echo.Context) error {
 		return c.NoContent(http.StatusNoContent)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Account routes. Forms with invalid input are rendered again with a 422
+	// status, or 400 for input the form itself should have refused, which
+	// index.js lets htmx swap in.
+
+	e.GET("/register", func(c echo.Context) error {
+		return c.Render(200, "register", nil)
+	})
+
+	e.POST("/register", func(c echo.Context) error {
+		username, password := c.FormValue("username"), c.FormValue("password")
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		_, err := internal.RegisterUser(ctx, users, username, password)
+		switch {
+		case errors.Is(err, internal.ErrUserExists),
+			errors.Is(err, internal.ErrInvalidUsername),
+			errors.Is(err, internal.ErrUsernameReserved),
+			errors.Is(err, internal.ErrPasswordTooShort):
+			return c.Render(http.StatusUnprocessableEntity, "register", formData(username, err))
+		case errors.Is(err, internal.ErrPasswordTooLong):
+			return c.Render(http.StatusBadRequest, "register", formData(username, err))
+		case err != nil:
+			return internal.DBError(c, err, "Failed to register user")
+		}
+
+		if err := sessions.Start(c, username); err != nil {
+			return internal.DBError(c, err, "Failed to sign in")
+		}
+		internal.Logger(c).Info("User registered", "user", username)
+		return redirect(c, "/")
+	})
+
+	e.GET("/login", func(c echo.Context) error {
+		return c.Render(200, "login", nil)
+	})
+
+	e.POST("/login", func(c echo.Context) error {
+		username, password := c.FormValue("username"), c.FormValue("password")
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		_, err := internal.AuthenticateUser(ctx, users, username, password)
+		switch {
+		case errors.Is(err, internal.ErrInvalidCredentials):
+			internal.Logger(c).Info("Failed login", "user", username)
+			return c.Render(http.StatusUnprocessableEntity, "login", formData(username, err))
+		case err != nil:
+			return internal.DBError(c, err, "Failed to sign in")
+		}
+
+		if err := sessions.Start(c, username); err != nil {
+			return internal.DBError(c, err, "Failed to sign in")
+		}
+		return redirect(c, "/")
+	})
+
+	// Access tokens for the method services. The token is issued either for
+	// the signed-in user or for the username and password in the request.
+	e.POST("/auth/token", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		var user *internal.User
+		if username := internal.CurrentUser(c); username != "" {
+			user, err = internal.FindUser(ctx, users, username)
+		} else {
+			var credentials struct {
+				Username string `json:"username" form:"username"`
+				Password string `json:"password" form:"password"`
+			}
+			if err := c.Bind(&credentials); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			}
+			user, err = internal.AuthenticateUser(ctx, users, credentials.Username, credentials.Password)
+		}
+		if errors.Is(err, internal.ErrInvalidCredentials) || errors.Is(err, mongo.ErrNoDocuments) {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Invalid username or password"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to issue token")
+		}
+
+		token, expires, err := signer.Sign(user.Username, user.Roles)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to issue token"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   int(time.Until(expires).Seconds()),
+		})
+	})
+
+	// Public keys of the tokens, fetched by the method services
+	e.GET(internal.JWKSPath, func(c echo.Context) error {
+		return c.JSON(http.StatusOK, signer.JWKS())
+	})
+
+	e.POST("/logout", func(c echo.Context) error {
+		if err := sessions.End(c); err != nil {
+			return internal.DBError(c, err, "Failed to sign out")
+		}
+		return redirect(c, "/")
 	})
 
-	// Start the frontend server on port 8080
-	e.Logger.Fatal(e.Start(":8080"))
+	// Start the frontend server on the configured port
+	internal.Start(e, cfg.Addr())
+}
+
+// sseHeartbeat is how often an idle event stream is written to
+const sseHeartbeat = 30 * time.Second
+
+// writeEvent writes a Server-Sent Event, one data line per line of data
+func writeEvent(w io.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// formData is the data of the login and register templates
+func formData(username string, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"Username": username,
+		"Error":    err.Error(),
+	}
+}
+
+// redirect sends the browser to another page. htmx requests are told to
+// load the page through the HX-Redirect header, as they would otherwise only
+// swap the response into the current page.
+func redirect(c echo.Context, url string) error {
+	if c.Request().Header.Get("HX-Request") == "true" {
+		c.Response().Header().Set("HX-Redirect", url)
+		return c.NoContent(http.StatusOK)
+	}
+	return c.Redirect(http.StatusSeeOther, url)
 }
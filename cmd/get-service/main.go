@@ -2,9 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
 
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
@@ -12,52 +17,376 @@ import (
 )
 
 func main() {
-	client, ctx, cancel, err := internal.ConnectDB()
+	cfg, err := config.Load("get-service", 8081, os.Args[1:])
 	if err != nil {
-		panic(err)
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("get-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "get-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
 	}
 	defer cancel()
 	defer client.Disconnect(ctx)
 
-	coll, err := internal.PrepareDatabase(client, "exercise-1", "information")
+	coll, err := internal.PrepareDatabase(client, cfg.Database, cfg.Collection)
+	if err != nil {
+		internal.Fatal("Error preparing database", err)
+	}
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
+	}
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
+
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	audit, err := internal.PrepareAudit(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing audit log", err)
+	}
+	revisions, err := internal.PrepareRevisions(ctx, client.Database(cfg.Database))
 	if err != nil {
-		panic(err)
+		internal.Fatal("Error preparing revisions", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+	circ, err := internal.PrepareCirculation(ctx, client.Database(cfg.Database), coll, outbox, internal.CirculationPolicy{
+		LoanPeriod: cfg.LoanPeriod,
+		HoldPeriod: cfg.HoldPeriod,
+		MaxLoans:   cfg.MaxLoans,
+		FinePerDay: cfg.FinePerDay,
+	})
+	if err != nil {
+		internal.Fatal("Error preparing loans", err)
+	}
+	reviews, err := internal.PrepareReviews(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing reviews", err)
 	}
-	internal.PrepareData(client, coll)
 
-	e := echo.New()
+	// Books and lists are cached for CACHE_TTL and dropped as soon as a
+	// write service publishes a change of the book to the outbox
+	cache := internal.NewCache(cfg.CacheSize, cfg.CacheTTL)
+	if cache != nil {
+		feedCtx, stopFeed := context.WithCancel(context.Background())
+		defer stopFeed()
+		changes, _ := internal.StartOutboxFeed(feedCtx, outbox).Subscribe()
+		go cache.Invalidate(changes)
+	}
+
+	e := internal.NewServer("get-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
+
+	// Reading the catalog requires the reader role, which requests without
+	// credentials get unless ANONYMOUS_ROLE is "none". Every client may send
+	// READ_RATE_LIMIT requests per minute.
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+	limiter := internal.NewRateLimiter(cfg.ReadRateLimit)
+	// Every IP address is limited before its credentials are checked
+	ipLimiter := internal.NewRateLimiter(cfg.IPRateLimit)
+	api := e.Group("/api", ipLimiter.IPMiddleware(), auth.Authenticate, limiter.Middleware(), internal.RequireRole(internal.RoleReader))
+
+	api.GET("/books", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
 
-	e.GET("/api/books", func(c echo.Context) error {
-		books := internal.FindAllBooks(coll)
+		books, err := cache.Fetch(c, "books", func() (interface{}, error) {
+			return internal.FindAllBooks(ctx, coll)
+		})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve books")
+		}
 		return c.JSON(http.StatusOK, books)
 	})
 
-	e.GET("/api/authors", func(c echo.Context) error {
-		authors := internal.FindAllAuthors(coll)
+	api.GET("/authors", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		authors, err := cache.Fetch(c, "authors", func() (interface{}, error) {
+			return internal.FindAllAuthors(ctx, coll)
+		})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve authors")
+		}
 		return c.JSON(http.StatusOK, authors)
 	})
 
-	e.GET("/api/books/:id", func(c echo.Context) error {
+	api.GET("/books/:id", func(c echo.Context) error {
 		id := c.Param("id")
 
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
 		// Query MongoDB for a book with the matching ID
-		var book internal.BookStore
-		err := coll.FindOne(context.TODO(), bson.M{"id": id}).Decode(&book)
+		book, err := cache.Fetch(c, internal.BookKey(id), func() (interface{}, error) {
+			var book internal.BookStore
+			err := coll.FindOne(ctx, internal.NotDeleted(bson.M{"id": id})).Decode(&book)
+			return book, err
+		})
 
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
 				return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve book"})
+			return internal.DBError(c, err, "Failed to retrieve book")
 		}
 
 		return c.JSON(http.StatusOK, book)
 	})
 
-	e.GET("/api/years", func(c echo.Context) error {
-		years := internal.FindAllYears(coll)
+	api.GET("/years", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		years, err := cache.Fetch(c, "years", func() (interface{}, error) {
+			return internal.FindAllYears(ctx, coll)
+		})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve years")
+		}
 		return c.JSON(http.StatusOK, years)
 	})
 
-	e.Logger.Fatal(e.Start(":8081"))
+	// Previous versions of a book, newest first, each with the change that
+	// replaced it
+	api.GET("/books/:id/history", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		history, err := internal.ListRevisions(ctx, revisions, c.Param("id"))
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve history")
+		}
+		return c.JSON(http.StatusOK, history)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Deleted books that can still be restored, with the date they will be
+	// purged
+	api.GET("/trash", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		trash, err := internal.ListTrash(ctx, coll, cfg.TrashRetention)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve trash")
+		}
+		return c.JSON(http.StatusOK, trash)
+	}, internal.RequireRole(internal.RoleAdmin))
+
+	// Changes of the catalog, newest first. Filtered by ?book=<id>,
+	// ?actor=<subject> and the time range ?from=&to= (RFC 3339).
+	api.GET("/audit", func(c echo.Context) error {
+		filter := internal.AuditFilter{
+			BookID: c.QueryParam("book"),
+			Actor:  c.QueryParam("actor"),
+			Limit:  100,
+		}
+		for param, t := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+			if v := c.QueryParam(param); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid " + param + " time, expected RFC 3339"})
+				}
+				*t = parsed
+			}
+		}
+		if v := c.QueryParam("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > 1000 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Limit must be between 1 and 1000"})
+			}
+			filter.Limit = int64(limit)
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		entries, err := internal.ListAudit(ctx, audit, filter)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve audit log")
+		}
+		return c.JSON(http.StatusOK, entries)
+	}, internal.RequireRole(internal.RoleAdmin))
+
+	// Loans, most recent first. Filtered by ?book=<id>, ?borrower= and
+	// ?status=open or overdue.
+	api.GET("/loans", func(c echo.Context) error {
+		filter := internal.LoanFilter{
+			BookID:   c.QueryParam("book"),
+			Borrower: c.QueryParam("borrower"),
+		}
+		switch c.QueryParam("status") {
+		case "":
+		case "open":
+			filter.Open = true
+		case "overdue":
+			filter.OverdueAt = time.Now()
+		default:
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Status must be open or overdue"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := circ.ListLoans(ctx, filter)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve loans")
+		}
+		return c.JSON(http.StatusOK, list)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Open loans past their due date
+	api.GET("/loans/overdue", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := circ.ListLoans(ctx, internal.LoanFilter{OverdueAt: time.Now()})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve overdue loans")
+		}
+		return c.JSON(http.StatusOK, list)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Holds, oldest first. Readers see their own, librarians everyone's or
+	// those of ?borrower=. Filtered by ?book=<id> and ?active=true.
+	api.GET("/holds", func(c echo.Context) error {
+		borrower := c.QueryParam("borrower")
+		if !internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian) {
+			var ok bool
+			if borrower, ok = internal.ActingBorrower(c, borrower); !ok {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Cannot list holds of this borrower"})
+			}
+		}
+		filter := internal.HoldFilter{
+			BookID:   c.QueryParam("book"),
+			Borrower: borrower,
+			Active:   c.QueryParam("active") == "true",
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := circ.ListHolds(ctx, filter)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve holds")
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	// Queue of a book: the active holds with the position of each waiting one
+	api.GET("/books/:id/holds", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := circ.ListHolds(ctx, internal.HoldFilter{BookID: c.Param("id"), Active: true})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve holds")
+		}
+		return c.JSON(http.StatusOK, list)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Notifications of the caller, e.g. that a hold is ready for pickup.
+	// Librarians may read those of ?recipient=.
+	api.GET("/notifications", func(c echo.Context) error {
+		recipient, ok := internal.ActingBorrower(c, c.QueryParam("recipient"))
+		if !ok {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Cannot read notifications of this recipient"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := circ.ListNotifications(ctx, recipient)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve notifications")
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	// Approved reviews of a book, newest first. Librarians may list the
+	// reviews in another ?status=.
+	api.GET("/books/:id/reviews", func(c echo.Context) error {
+		status := internal.ReviewApproved
+		if v := c.QueryParam("status"); v != "" && v != status {
+			if !internal.CurrentPrincipal(c).HasRole(internal.RoleLibrarian) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Only approved reviews are public"})
+			}
+			status = v
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := internal.ListReviews(ctx, reviews, internal.ReviewFilter{BookID: c.Param("id"), Status: status})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve reviews")
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	// Reviews of all books for moderation, newest first, pending ones unless
+	// another ?status= is given
+	api.GET("/reviews", func(c echo.Context) error {
+		status := c.QueryParam("status")
+		if status == "" {
+			status = internal.ReviewPending
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := internal.ListReviews(ctx, reviews, internal.ReviewFilter{Status: status})
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve reviews")
+		}
+		return c.JSON(http.StatusOK, list)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Members sorted by name, filtered by ?status=active or suspended
+	api.GET("/members", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		members, err := internal.ListMembers(ctx, circ.Members, c.QueryParam("status"))
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve members")
+		}
+		return c.JSON(http.StatusOK, members)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// A member, readable by librarians and the member themselves
+	api.GET("/members/:id", func(c echo.Context) error {
+		id, ok := internal.ActingBorrower(c, c.Param("id"))
+		if !ok {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Cannot read this member"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		member, err := internal.FindMember(ctx, circ.Members, id)
+		if errors.Is(err, internal.ErrMemberNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve member")
+		}
+		return c.JSON(http.StatusOK, member)
+	})
+
+	internal.Start(e, cfg.Addr())
 }
@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"html/template"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"slices"
 	"time"
 
+	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
+
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -78,10 +79,9 @@ func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*m
 		return nil, err
 	}
 	if !slices.Contains(names, collecName) {
-		cmd := bson.D{{"create", collecName}}
+		cmd := bson.D{{Key: "create", Value: collecName}}
 		var result bson.M
 		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
-			log.Fatal(err)
 			return nil, err
 		}
 	}
@@ -90,77 +90,20 @@ func prepareDatabase(client *mongo.Client, dbName string, collecName string) (*m
 	return coll, nil
 }
 
-// Here we prepare some fictional data and we insert it into the database
-// the first time we connect to it. Otherwise, we check if it already exists.
-func prepareData(client *mongo.Client, coll *mongo.Collection) {
-	startData := []BookStore{
-		{
-			ID:          "example1",
-			BookName:    "The Vortex",
-			BookAuthor:  "José Eustasio Rivera",
-			BookEdition: "958-30-0804-4",
-			BookPages:   "292",
-			BookYear:    "1924",
-		},
-		{
-			ID:          "example2",
-			BookName:    "Frankenstein",
-			BookAuthor:  "Mary Shelley",
-			BookEdition: "978-3-649-64609-9",
-			BookPages:   "280",
-			BookYear:    "1818",
-		},
-		{
-			ID:          "example3",
-			BookName:    "The Black Cat",
-			BookAuthor:  "Edgar Allan Poe",
-			BookEdition: "978-3-99168-238-7",
-			BookPages:   "280",
-			BookYear:    "1843",
-		},
-	}
-
-	// This syntax helps us iterate over arrays. It behaves similar to Python
-	// However, range always returns a tuple: (idx, elem). You can ignore the idx
-	// by using _.
-	// In the topic of function returns: sadly, there is no standard on return types from function. Most functions
-	// return a tuple with (res, err), but this is not granted. Some functions
-	// might return a ret value that includes res and the err, others might have
-	// an out parameter.
-	for _, book := range startData {
-		cursor, err := coll.Find(context.TODO(), book)
-		var results []BookStore
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			panic(err)
-		}
-		if len(results) > 1 {
-			log.Fatal("more records were found")
-		} else if len(results) == 0 {
-			result, err := coll.InsertOne(context.TODO(), book)
-			if err != nil {
-				panic(err)
-			} else {
-				fmt.Printf("%+v\n", result)
-			}
-
-		} else {
-			for _, res := range results {
-				cursor.Decode(&res)
-				fmt.Printf("%+v\n", res)
-			}
-		}
-	}
-}
-
 // Generic method to perform "SELECT * FROM BOOKS" (if this was SQL, which
 // it is not :D ), and then we convert it into an array of map. In Golang, you
 // define a map by writing map[<key type>]<value type>{<key>:<value>}.
 // interface{} is a special type in Golang, basically a wildcard...
-func findAllBooks(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+// Deleted books stay in the collection until they are purged, so every read
+// skips them with internal.NotDeleted.
+func findAllBooks(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	cursor, err := coll.Find(ctx, internal.NotDeleted(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
 	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
@@ -176,14 +119,17 @@ func findAllBooks(coll *mongo.Collection) []map[string]interface{} {
 		})
 	}
 
-	return ret
+	return ret, nil
 }
 
-func findAllAuthors(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+func findAllAuthors(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	cursor, err := coll.Find(ctx, internal.NotDeleted(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
 	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
@@ -194,14 +140,17 @@ func findAllAuthors(coll *mongo.Collection) []map[string]interface{} {
 		})
 	}
 
-	return ret
+	return ret, nil
 }
 
-func findAllYears(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+func findAllYears(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	cursor, err := coll.Find(ctx, internal.NotDeleted(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
 	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
@@ -212,10 +161,29 @@ func findAllYears(coll *mongo.Collection) []map[string]interface{} {
 		})
 	}
 
-	return ret
+	return ret, nil
 }
 
 func main() {
+	// The configuration (ports, database URI, database and collection names)
+	// is shared with the split services, see internal/config.
+	cfg, err := config.Load("monolith", 8080, os.Args[1:])
+	if err != nil {
+		internal.Fatal("Invalid configuration", err)
+	}
+
+	// Every log line is written as JSON by log/slog. The logger is also
+	// installed as the default one, so slog.Info & co. use it as well.
+	logger := internal.NewLogger("monolith", cfg.LogLevel)
+
+	// Trace spans are exported as configured by TRACING_EXPORTER. The deferred
+	// shutdown flushes the spans that are still buffered.
+	shutdownTracing, err := internal.InitTracing(context.Background(), "monolith", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Connect to the database. Such defer keywords are used once the local
 	// context returns; for this case, the local context is the main function
 	// By user defer function, we make sure we don't leave connections
@@ -224,15 +192,12 @@ func main() {
 	defer cancel()
 
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	uri := os.Getenv("DATABASE_URI")
-	if uri == "" {
-		log.Fatal("DATABASE_URI environment variable not set")
-	}
-	opts := options.Client().ApplyURI(uri).SetServerAPIOptions(serverAPI)
+	// The monitor feeds the MongoDB latency and error metrics served on /metrics
+	opts := options.Client().ApplyURI(cfg.DatabaseURI).SetServerAPIOptions(serverAPI).SetMonitor(internal.MongoMonitor())
 
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
-		panic(err)
+		internal.Fatal("Failed to connect to DB", err)
 	}
 
 	// // TODO: make sure to pass the proper username, password, and port
@@ -242,68 +207,119 @@ func main() {
 	// functions (or anonymous functions, similar to the behavior in Python)
 	defer func() {
 		if err = client.Disconnect(ctx); err != nil {
-			panic(err)
+			logger.Error("Failed to disconnect from DB", "error", err)
 		}
 	}()
 
 	// You can use such name for the database and collection, or come up with
 	// one by yourself!
-	coll, err := prepareDatabase(client, "exercise-1", "information")
+	coll, err := prepareDatabase(client, cfg.Database, cfg.Collection)
 	if err != nil {
-		log.Fatalf("Error preparing database: %v", err)
+		internal.Fatal("Error preparing database", err)
 	}
 
-	prepareData(client, coll)
-
-	// Here we prepare the server
-	e := echo.New()
-
-	// e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
-	// 	return func(c echo.Context) error {
-	// 		fmt.Println(c.Request().Method, c.Request().URL.Path)
-	// 		return next(c)
-	// 	}
-	// })
+	// Insert some fictional books the first time we connect, see
+	// internal.PrepareData
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
+	}
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
+
+	// API requests are authenticated with an API key issued by cmd/apikey
+	// (only the hashes of the keys are stored in the database) or with an
+	// access token signed by the frontend-service. Every route then requires
+	// a role: readers may read, librarians also create and update books and
+	// only admins may delete them.
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+
+	// Every client gets a budget of requests per minute, a smaller one for
+	// writes. Clients over their budget are answered with 429.
+	readLimit := internal.NewRateLimiter(cfg.ReadRateLimit).Middleware()
+	writeLimit := internal.NewRateLimiter(cfg.WriteRateLimit).Middleware()
+	// Every IP address is limited before its credentials are checked, so
+	// floods of invalid credentials are not looked up one by one
+	ipLimit := internal.NewRateLimiter(cfg.IPRateLimit).IPMiddleware()
+
+	// Here we prepare the server. internal.NewServer installs the middleware
+	// shared with the split services: request IDs, access logs (have a look
+	// at echo's documentation on more middleware) and recovering from panics.
+	e := internal.NewServer("monolith", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
 
 	// Define our custom renderer
 	e.Renderer = loadTemplates()
 
-	// Log the requests. Please have a look at echo's documentation on more
-	// middleware
-	// e.Use(middleware.Logger())
-
 	e.Static("/css", "css")
+	if err := internal.CheckScripts("js"); err != nil {
+		internal.Fatal("Missing self-hosted scripts", err)
+	}
+	e.Static("/js", "js")
+
+	// The pages are locked down like in the frontend-service: only resources
+	// of the server itself may be loaded and every page request carries the
+	// CSRF token, which htmx sends back on requests changing state. The API
+	// authenticates with keys and tokens instead of cookies and needs none.
+	e.Use(internal.SecurityHeaders())
+	csrf := internal.CSRF(cfg.CookieSecure)
 
 	// Endpoint definition. Here, we divided into two groups: top-level routes
 	// starting with /, which usually serve webpages. For our RESTful endpoints,
 	// we prefix the route with /api to indicate more information or resources
 	// are available under such route.
 	e.GET("/", func(c echo.Context) error {
-		return c.Render(200, "index", nil)
-	})
+		return c.Render(200, "index", map[string]interface{}{
+			"CSRF": internal.CSRFToken(c),
+		})
+	}, csrf)
 
 	e.GET("/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
-		return c.Render(200, "book-table", books)
-	})
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		books, err := findAllBooks(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve books")
+		}
+		// Without a change feed the table is not updated live, unlike in the
+		// frontend-service
+		return c.Render(200, "book-table", map[string]interface{}{"Rows": internal.BookRows(books, false)})
+	}, csrf)
 
 	e.GET("/authors", func(c echo.Context) error {
-		authors := findAllAuthors(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		authors, err := findAllAuthors(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve authors")
+		}
 		return c.Render(200, "authors", authors)
-	})
+	}, csrf)
 
 	e.GET("/years", func(c echo.Context) error {
-		years := findAllYears(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		years, err := findAllYears(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve years")
+		}
 		return c.Render(200, "years", years)
-	})
+	}, csrf)
 
 	e.GET("/search", func(c echo.Context) error {
 		return c.Render(200, "search-bar", nil)
-	})
+	}, csrf)
 
 	e.GET("/create", func(c echo.Context) error {
 		return c.NoContent(http.StatusNoContent)
-	})
+	}, csrf)
 
 	// You will have to expand on the allowed methods for the path
 	// `/api/route`, following the common standard.
@@ -312,36 +328,59 @@ func main() {
 	// It specifies the expected returned codes for each type of request
 	// method.
 	e.GET("/api/books", func(c echo.Context) error {
-		books := findAllBooks(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		books, err := findAllBooks(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve books")
+		}
 		return c.JSON(http.StatusOK, books)
-	})
+	}, ipLimit, auth.Authenticate, readLimit, internal.RequireRole(internal.RoleReader))
 
 	e.GET("/api/authors", func(c echo.Context) error {
-		authors := findAllAuthors(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		authors, err := findAllAuthors(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve authors")
+		}
 		return c.JSON(http.StatusOK, authors)
-	})
+	}, ipLimit, auth.Authenticate, readLimit, internal.RequireRole(internal.RoleReader))
 
 	e.GET("/api/books/:id", func(c echo.Context) error {
 		id := c.Param("id")
 
+		// Every query is bound to the request: it is aborted when the client
+		// disconnects or when the configured deadline expires
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
 		// Query MongoDB for a book with the matching ID
 		var book BookStore
-		err := coll.FindOne(context.TODO(), bson.M{"id": id}).Decode(&book)
+		err := coll.FindOne(ctx, internal.NotDeleted(bson.M{"id": id})).Decode(&book)
 
 		if err != nil {
 			if err == mongo.ErrNoDocuments {
 				return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
 			}
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve book"})
+			return internal.DBError(c, err, "Failed to retrieve book")
 		}
 
 		return c.JSON(http.StatusOK, book)
-	})
+	}, ipLimit, auth.Authenticate, readLimit, internal.RequireRole(internal.RoleReader))
 
 	e.GET("/api/years", func(c echo.Context) error {
-		years := findAllYears(coll)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		years, err := findAllYears(ctx, coll)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve years")
+		}
 		return c.JSON(http.StatusOK, years)
-	})
+	}, ipLimit, auth.Authenticate, readLimit, internal.RequireRole(internal.RoleReader))
 
 	e.POST("/api/books", func(c echo.Context) error {
 		var book BookStore
@@ -367,11 +406,14 @@ func main() {
 			"bookpages":  book.BookPages,  // Matches 'bookpages'
 		}
 
-		log.Printf("POST filter: %+v\n", filter)
+		internal.Logger(c).Debug("POST filter", "filter", filter)
 
-		count, err := coll.CountDocuments(context.TODO(), filter)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		count, err := coll.CountDocuments(ctx, filter)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check for existing book"})
+			return internal.DBError(c, err, "Failed to check for existing book")
 		}
 
 		if count > 0 {
@@ -379,9 +421,9 @@ func main() {
 		}
 
 		// Insert the book into the database
-		result, err := coll.InsertOne(context.TODO(), book)
+		result, err := coll.InsertOne(ctx, book)
 		if err != nil {
-			return c.JSON(http.StatusOK, map[string]string{"error": "Failed to insert book"})
+			return internal.DBError(c, err, "Failed to insert book")
 		}
 
 		// Return success response with the inserted ID
@@ -389,7 +431,7 @@ func main() {
 			"message": "Book created successfully",
 			"id":      result.InsertedID,
 		})
-	})
+	}, ipLimit, auth.Authenticate, writeLimit, internal.RequireRole(internal.RoleLibrarian))
 
 	e.PUT("/api/books/:id", func(c echo.Context) error {
 		id := c.Param("id")
@@ -422,42 +464,53 @@ func main() {
 		delete(updates, "id")
 		delete(updates, "_id")
 
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
 		// Update the book in the database
-		filter := bson.M{"id": id}
+		filter := internal.NotDeleted(bson.M{"id": id})
 		update := bson.M{"$set": updates}
-		result, err := coll.UpdateOne(context.TODO(), filter, update)
+		result, err := coll.UpdateOne(ctx, filter, update)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update book"})
+			return internal.DBError(c, err, "Failed to update book")
 		}
 		if result.MatchedCount == 0 {
 			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
 		}
 
 		return c.JSON(http.StatusOK, map[string]string{"message": "Book updated successfully"})
-	})
+	}, ipLimit, auth.Authenticate, writeLimit, internal.RequireRole(internal.RoleLibrarian))
 
 	// DELETE: Delete a book by ID
 	e.DELETE("/api/books/:id", func(c echo.Context) error {
 		id := c.Param("id")
 
-		// Delete the book from the database
-		filter := bson.M{"id": id}
-		result, err := coll.DeleteOne(context.TODO(), filter)
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		// Move the book to the trash: it is only marked as deleted, the
+		// delete-service purges it once the retention period is over
+		filter := internal.NotDeleted(bson.M{"id": id})
+		update := bson.M{"$set": bson.M{
+			"deleted_at": time.Now().UTC(),
+			"deleted_by": internal.CurrentPrincipal(c).Subject,
+		}}
+		result, err := coll.UpdateOne(ctx, filter, update)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete book"})
+			return internal.DBError(c, err, "Failed to delete book")
 		}
-		if result.DeletedCount == 0 {
+		if result.MatchedCount == 0 {
 			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
 		}
 
 		return c.JSON(http.StatusOK, map[string]string{"message": "Book deleted successfully"})
-	})
+	}, ipLimit, auth.Authenticate, writeLimit, internal.RequireRole(internal.RoleAdmin))
 
-	// We start the server and bind it to port 3030. For future references, this
+	// We start the server and bind it to the configured port. For future references, this
 	// is the application's port and not the external one. For this first exercise,
 	// they could be the same if you use a Cloud Provider. If you use ngrok or similar,
 	// they might differ.
 	// In the submission website for this exercise, you will have to provide the internet-reachable
 	// endpoint: http://<host>:<external-port>
-	e.Logger.Fatal(e.Start(":8080"))
+	internal.Start(e, cfg.Addr())
 }
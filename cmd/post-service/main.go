@@ -2,31 +2,108 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 
 	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
 
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func main() {
-	client, ctx, cancel, err := internal.ConnectDB()
+	cfg, err := config.Load("post-service", 8083, os.Args[1:])
 	if err != nil {
-		panic(err)
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("post-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "post-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
 	}
 	defer cancel()
 	defer client.Disconnect(ctx)
 
-	coll, err := internal.PrepareDatabase(client, "exercise-1", "information")
+	coll, err := internal.PrepareDatabase(client, cfg.Database, cfg.Collection)
 	if err != nil {
-		panic(err)
+		internal.Fatal("Error preparing database", err)
+	}
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
 	}
-	internal.PrepareData(client, coll)
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
+
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	audit, err := internal.PrepareAudit(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing audit log", err)
+	}
+	revisions, err := internal.PrepareRevisions(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing revisions", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+	circ, err := internal.PrepareCirculation(ctx, client.Database(cfg.Database), coll, outbox, internal.CirculationPolicy{
+		LoanPeriod: cfg.LoanPeriod,
+		HoldPeriod: cfg.HoldPeriod,
+		MaxLoans:   cfg.MaxLoans,
+		FinePerDay: cfg.FinePerDay,
+	})
+	if err != nil {
+		internal.Fatal("Error preparing loans", err)
+	}
+	reviews, err := internal.PrepareReviews(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing reviews", err)
+	}
+	idempotency, err := internal.PrepareIdempotency(ctx, client.Database(cfg.Database), cfg.IdempotencyTTL, cfg.QueryTimeout)
+	if err != nil {
+		internal.Fatal("Error preparing idempotency keys", err)
+	}
+
+	// Copies kept for holds that were not picked up within HOLD_PERIOD go to
+	// the next hold
+	expiryCtx, stopExpiry := context.WithCancel(context.Background())
+	defer stopExpiry()
+	internal.StartHoldExpirer(expiryCtx, circ, cfg.QueryTimeout)
+
+	e := internal.NewServer("post-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
 
-	e := echo.New()
+	// Requests are authenticated with an API key (see cmd/apikey) or an
+	// access token issued by the frontend, verified locally with the shared
+	// secret or the frontend's JWKS. Each route then checks the caller's role.
+	// Writes are limited more strictly than reads (WRITE_RATE_LIMIT).
+	// Requests with an Idempotency-Key header can be retried safely: retries
+	// get the response of the first attempt for IDEMPOTENCY_TTL.
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+	limiter := internal.NewRateLimiter(cfg.WriteRateLimit)
+	// Every IP address is limited before its credentials are checked
+	ipLimiter := internal.NewRateLimiter(cfg.IPRateLimit)
+	api := e.Group("/api", ipLimiter.IPMiddleware(), auth.Authenticate, limiter.Middleware(), idempotency.Middleware())
 
-	e.POST("/api/books", func(c echo.Context) error {
+	api.POST("/books", func(c echo.Context) error {
 		var book internal.BookStore
 		if err := c.Bind(&book); err != nil {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
@@ -35,27 +112,336 @@ func main() {
 		if book.ID == "" || book.BookName == "" || book.BookAuthor == "" {
 			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing mandatory fields"})
 		}
+		if book.Copies < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Copies must not be negative"})
+		}
+		// Only loans and holds take copies, only reviews rate the book
+		book.OnLoan, book.OnHold = 0, 0
+		book.Rating, book.ReviewCount = 0, 0
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
 
 		filter := bson.M{"id": book.ID}
-		count, err := coll.CountDocuments(context.TODO(), filter)
+		count, err := coll.CountDocuments(ctx, filter)
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to check for existing book"})
+			return internal.DBError(c, err, "Failed to check for existing book")
 		}
 
 		if count > 0 {
 			return c.JSON(http.StatusOK, map[string]string{"message": "Missing mandatory fields"})
 		}
 
-		result, err := coll.InsertOne(context.TODO(), book)
+		// The book, its audit entry and its event are stored together, see
+		// internal/outbox.go
+		var result *mongo.InsertOneResult
+		err = internal.WithTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+			result, err = coll.InsertOne(ctx, book)
+			if err != nil {
+				return err
+			}
+			entry := internal.NewAuditEntry(internal.RequestActor(c), internal.AuditCreate, book.ID, nil, internal.BookDocument(book))
+			if err := internal.WriteAudit(ctx, audit, entry); err != nil {
+				return err
+			}
+			return internal.Publish(ctx, outbox, internal.BookCreated, book.ID, internal.BookDocument(book))
+		})
 		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to insert book"})
+			return internal.DBError(c, err, "Failed to insert book")
 		}
 
 		return c.JSON(http.StatusCreated, map[string]interface{}{
 			"message": "Book created successfully",
 			"id":      result.InsertedID,
 		})
-	})
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Bulk import of a JSON array of books. Books whose ID already exists are
+	// skipped, so an import can safely be retried.
+	api.POST("/books/import", func(c echo.Context) error {
+		var books []internal.BookStore
+		if err := c.Bind(&books); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		for i, book := range books {
+			if book.ID == "" || book.BookName == "" || book.BookAuthor == "" {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("Missing mandatory fields in book %d", i),
+				})
+			}
+			if book.Copies < 0 {
+				return c.JSON(http.StatusBadRequest, map[string]string{
+					"error": fmt.Sprintf("Negative copies in book %d", i),
+				})
+			}
+			books[i].OnLoan, books[i].OnHold = 0, 0
+			books[i].Rating, books[i].ReviewCount = 0, 0
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		var models []mongo.WriteModel
+		for _, book := range books {
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"id": book.ID}).
+				SetUpdate(bson.M{"$setOnInsert": book}).
+				SetUpsert(true))
+		}
+		imported := 0
+		if len(models) > 0 {
+			var result *mongo.BulkWriteResult
+			err := internal.WithTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+				var err error
+				result, err = coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+				if err != nil {
+					return err
+				}
+
+				// Only the books that did not exist yet were imported
+				var entries []internal.AuditEntry
+				actor := internal.RequestActor(c)
+				for i := range result.UpsertedIDs {
+					book := books[i]
+					entries = append(entries,
+						internal.NewAuditEntry(actor, internal.AuditImport, book.ID, nil, internal.BookDocument(book)))
+					if err := internal.Publish(ctx, outbox, internal.BookCreated, book.ID, internal.BookDocument(book)); err != nil {
+						return err
+					}
+				}
+				return internal.WriteAudit(ctx, audit, entries...)
+			})
+			if err != nil {
+				return internal.DBError(c, err, "Failed to import books")
+			}
+			imported = int(result.UpsertedCount)
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message":  "Books imported successfully",
+			"imported": imported,
+			"skipped":  len(books) - imported,
+		})
+	}, internal.RequireRole(internal.RoleAdmin))
+
+	// Takes a deleted book out of the trash (see GET /api/trash)
+	api.POST("/books/:id/restore", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		err := internal.RestoreBook(ctx, coll, audit, outbox, internal.RequestActor(c), c.Param("id"))
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not in trash"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to restore book")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Book restored successfully"})
+	}, internal.RequireRole(internal.RoleAdmin))
+
+	// Restores a previous version of a book (see GET /api/books/:id/history)
+	api.POST("/books/:id/revert/:rev", func(c echo.Context) error {
+		id := c.Param("id")
+		rev, err := strconv.Atoi(c.Param("rev"))
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid revision"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		err = internal.RevertBook(ctx, coll, revisions, audit, outbox, internal.RequestActor(c), id, rev)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
+		case errors.Is(err, internal.ErrRevisionNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Revision not found"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to revert book")
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"message": "Book reverted successfully",
+			"rev":     rev,
+		})
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Lends a copy of the book to the member in the body, due after
+	// LOAN_PERIOD. A copy kept for a hold of the member is lent first. The
+	// member must be active, without fines due and below MAX_LOANS.
+	api.POST("/books/:id/checkout", func(c echo.Context) error {
+		var body struct {
+			Borrower string `json:"borrower"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if body.Borrower == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing borrower"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		loan, err := circ.Checkout(ctx, internal.RequestActor(c), c.Param("id"), body.Borrower)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
+		case errors.Is(err, internal.ErrNoCopyAvailable):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "No copy available"})
+		case errors.Is(err, internal.ErrMemberNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		case errors.Is(err, internal.ErrMemberInactive):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Membership suspended or expired"})
+		case errors.Is(err, internal.ErrFinesDue):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Member has fines due"})
+		case errors.Is(err, internal.ErrLoanLimit):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Member reached the loan limit"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to check out book")
+		}
+		return c.JSON(http.StatusCreated, loan)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Takes back the copy lent to the member in the body and charges
+	// FINE_PER_DAY if it is late. The copy is kept for the next hold on the
+	// book, whose member is notified.
+	api.POST("/books/:id/return", func(c echo.Context) error {
+		var body struct {
+			Borrower string `json:"borrower"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		if body.Borrower == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Missing borrower"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		loan, err := circ.Return(ctx, c.Param("id"), body.Borrower)
+		if errors.Is(err, internal.ErrLoanNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "No open loan of this book to the borrower"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to return book")
+		}
+		return c.JSON(http.StatusOK, loan)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Queues a borrower for a book whose copies are all taken. Readers place
+	// holds for themselves, librarians for the borrower in the body.
+	api.POST("/books/:id/holds", func(c echo.Context) error {
+		var body struct {
+			Borrower string `json:"borrower"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		borrower, ok := internal.ActingBorrower(c, body.Borrower)
+		if !ok {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Cannot place holds for this borrower"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		hold, err := circ.PlaceHold(ctx, c.Param("id"), borrower)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
+		case errors.Is(err, internal.ErrCopyAvailable):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "A copy is available, check it out instead"})
+		case errors.Is(err, internal.ErrHoldExists):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Borrower already holds this book"})
+		case errors.Is(err, internal.ErrMemberNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		case errors.Is(err, internal.ErrMemberInactive):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Membership suspended or expired"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to place hold")
+		}
+		return c.JSON(http.StatusCreated, hold)
+	}, internal.RequireRole(internal.RoleReader))
+
+	// Reviews a book with {"rating": 1-5, "text": "..."}. The review is
+	// shown once a librarian approved it.
+	api.POST("/books/:id/reviews", func(c echo.Context) error {
+		var body struct {
+			Rating int    `json:"rating"`
+			Text   string `json:"text"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+		author, ok := internal.ActingBorrower(c, "")
+		if !ok {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Sign in to review books"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		review, err := internal.AddReview(ctx, coll, reviews, c.Param("id"), author, body.Rating, body.Text)
+		switch {
+		case errors.Is(err, mongo.ErrNoDocuments):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Book not found"})
+		case errors.Is(err, internal.ErrInvalidReview):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, internal.ErrReviewExists):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "You already reviewed this book"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to save review")
+		}
+		return c.JSON(http.StatusCreated, review)
+	}, internal.RequireRole(internal.RoleReader))
+
+	// Creates a member. To let an account or API key borrow for itself, the
+	// ID must be its username or "apikey:<id>" (see docs/members.md).
+	api.POST("/members", func(c echo.Context) error {
+		var member internal.Member
+		if err := c.Bind(&member); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		created, err := internal.CreateMember(ctx, circ.Members, member)
+		switch {
+		case errors.Is(err, internal.ErrInvalidMember):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, internal.ErrMemberExists):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Member already exists"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to create member")
+		}
+		return c.JSON(http.StatusCreated, created)
+	}, internal.RequireRole(internal.RoleLibrarian))
+
+	// Books a payment of {"amount": <cents>} against the fines of a member
+	api.POST("/members/:id/payments", func(c echo.Context) error {
+		var body struct {
+			Amount int `json:"amount"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		member, err := internal.PayFines(ctx, circ.Members, c.Param("id"), body.Amount)
+		switch {
+		case errors.Is(err, internal.ErrMemberNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		case errors.Is(err, internal.ErrInvalidPayment):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to book payment")
+		}
+		return c.JSON(http.StatusOK, member)
+	}, internal.RequireRole(internal.RoleLibrarian))
 
-	e.Logger.Fatal(e.Start(":8083"))
+	internal.Start(e, cfg.Addr())
 }
@@ -2,31 +2,94 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"os"
 
 	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
 
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	client, ctx, cancel, err := internal.ConnectDB()
+	cfg, err := config.Load("put-service", 8084, os.Args[1:])
 	if err != nil {
-		panic(err)
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("put-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "put-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
 	}
 	defer cancel()
 	defer client.Disconnect(ctx)
 
-	coll, err := internal.PrepareDatabase(client, "exercise-1", "information")
+	coll, err := internal.PrepareDatabase(client, cfg.Database, cfg.Collection)
+	if err != nil {
+		internal.Fatal("Error preparing database", err)
+	}
+	if err := internal.PrepareData(client, coll); err != nil {
+		internal.Fatal("Error preparing data", err)
+	}
+	internal.RegisterCatalogSize(coll, cfg.QueryTimeout)
+
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	audit, err := internal.PrepareAudit(ctx, client.Database(cfg.Database))
 	if err != nil {
-		panic(err)
+		internal.Fatal("Error preparing audit log", err)
+	}
+	revisions, err := internal.PrepareRevisions(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing revisions", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+	circ, err := internal.PrepareCirculation(ctx, client.Database(cfg.Database), coll, outbox, internal.CirculationPolicy{
+		LoanPeriod: cfg.LoanPeriod,
+		HoldPeriod: cfg.HoldPeriod,
+		MaxLoans:   cfg.MaxLoans,
+		FinePerDay: cfg.FinePerDay,
+	})
+	if err != nil {
+		internal.Fatal("Error preparing loans", err)
+	}
+	reviews, err := internal.PrepareReviews(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing reviews", err)
 	}
-	internal.PrepareData(client, coll)
 
-	e := echo.New()
+	e := internal.NewServer("put-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
 
-	e.PUT("/api/books/:id", func(c echo.Context) error {
+	// Requests are authenticated with an API key (see cmd/apikey) or an
+	// access token issued by the frontend, verified locally with the shared
+	// secret or the frontend's JWKS. Each route then checks the caller's role.
+	// Writes are limited more strictly than reads (WRITE_RATE_LIMIT).
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+	limiter := internal.NewRateLimiter(cfg.WriteRateLimit)
+	// Every IP address is limited before its credentials are checked
+	ipLimiter := internal.NewRateLimiter(cfg.IPRateLimit)
+	api := e.Group("/api", ipLimiter.IPMiddleware(), auth.Authenticate, limiter.Middleware())
+
+	// PATCH is an alias of PUT: both only change the fields in the body
+	update := func(c echo.Context) error {
 		id := c.Param("id")
 		var updatesFromRequest map[string]interface{}
 		var updates bson.M = make(bson.M)
@@ -52,24 +115,129 @@ func main() {
 		if year, ok := updatesFromRequest["year"]; ok {
 			updates["bookyear"] = year
 		}
+		if copies, ok := updatesFromRequest["copies"]; ok {
+			n, ok := copies.(float64)
+			if !ok || n < 1 || n != float64(int(n)) {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Copies must be a positive whole number"})
+			}
+			updates["copies"] = int(n)
+		}
 
 		// Remove ID and MongoID from updates (if they were accidentally sent)
 		delete(updates, "id")
 		delete(updates, "_id")
 
-		// Update the book in the database
-		filter := bson.M{"id": id}
-		update := bson.M{"$set": updates}
-		result, err := coll.UpdateOne(context.TODO(), filter, update)
-		if err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update book"})
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		// Update the book in the database together with its audit entry,
+		// revision and event. The document before the update is returned for
+		// the audit log and becomes the revision. Copies on loan or on hold
+		// cannot be removed.
+		filter := internal.NotDeleted(bson.M{"id": id})
+		if copies, ok := updates["copies"].(int); ok {
+			filter = internal.TakenAtMost(filter, copies)
 		}
-		if result.MatchedCount == 0 {
+		update := bson.M{"$set": updates}
+		actor := internal.RequestActor(c)
+		var before, after bson.M
+		err := internal.WithTransaction(ctx, client, func(ctx mongo.SessionContext) error {
+			err := coll.FindOneAndUpdate(ctx, filter, update).Decode(&before)
+			if errors.Is(err, mongo.ErrNoDocuments) && updates["copies"] != nil {
+				count, err := coll.CountDocuments(ctx, internal.NotDeleted(bson.M{"id": id}))
+				if err != nil {
+					return err
+				}
+				if count > 0 {
+					return internal.ErrCopiesTaken
+				}
+				return mongo.ErrNoDocuments
+			}
+			if err != nil {
+				return err
+			}
+			after = bson.M{}
+			for field, value := range before {
+				after[field] = value
+			}
+			for field, value := range updates {
+				after[field] = value
+			}
+			entry := internal.NewAuditEntry(actor, internal.AuditUpdate, id, before, after)
+			if err := internal.WriteAudit(ctx, audit, entry); err != nil {
+				return err
+			}
+			if err := internal.SaveRevision(ctx, revisions, actor, id, before, after); err != nil {
+				return err
+			}
+			return internal.Publish(ctx, outbox, internal.BookUpdated, id, after)
+		})
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			return c.JSON(http.StatusOK, map[string]string{"message": "Book not found"})
 		}
+		if errors.Is(err, internal.ErrCopiesTaken) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Copies cannot be fewer than the copies on loan or on hold"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to update book")
+		}
 
 		return c.JSON(http.StatusOK, map[string]string{"message": "Book updated successfully"})
-	})
+	}
+	api.PUT("/books/:id", update, internal.RequireRole(internal.RoleLibrarian))
+	api.PATCH("/books/:id", update, internal.RequireRole(internal.RoleLibrarian))
+
+	// Changes the name, email, status, expiry or loan limit of a member.
+	// Suspended and expired members cannot borrow or place holds.
+	updateMember := func(c echo.Context) error {
+		var update internal.MemberUpdate
+		if err := c.Bind(&update); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		member, err := internal.UpdateMember(ctx, circ.Members, c.Param("id"), update)
+		switch {
+		case errors.Is(err, internal.ErrMemberNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Member not found"})
+		case errors.Is(err, internal.ErrInvalidMember):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to update member")
+		}
+		return c.JSON(http.StatusOK, member)
+	}
+	api.PUT("/members/:id", updateMember, internal.RequireRole(internal.RoleLibrarian))
+	api.PATCH("/members/:id", updateMember, internal.RequireRole(internal.RoleLibrarian))
+
+	// Moderates a review with {"status": "approved"} or "rejected". The
+	// rating of the book is updated with it.
+	moderate := func(c echo.Context) error {
+		var body struct {
+			Status string `json:"status"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		review, err := internal.ModerateReview(ctx, coll, reviews, outbox, internal.RequestActor(c), c.Param("id"), body.Status)
+		switch {
+		case errors.Is(err, internal.ErrInvalidReview):
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		case errors.Is(err, internal.ErrReviewNotFound):
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Review not found"})
+		case err != nil:
+			return internal.DBError(c, err, "Failed to moderate review")
+		}
+		return c.JSON(http.StatusOK, review)
+	}
+	api.PUT("/reviews/:id", moderate, internal.RequireRole(internal.RoleLibrarian))
+	api.PATCH("/reviews/:id", moderate, internal.RequireRole(internal.RoleLibrarian))
 
-	e.Logger.Fatal(e.Start(":8084"))
+	internal.Start(e, cfg.Addr())
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
+
+	"github.com/labstack/echo/v4"
+)
+
+func main() {
+	cfg, err := config.Load("relay-service", 8085, os.Args[1:])
+	if err != nil {
+		internal.Fatal("Invalid configuration", err)
+	}
+	logger := internal.NewLogger("relay-service", cfg.LogLevel)
+
+	shutdownTracing, err := internal.InitTracing(context.Background(), "relay-service", cfg.TracingExporter)
+	if err != nil {
+		internal.Fatal("Failed to set up tracing", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
+	}
+	defer cancel()
+	defer client.Disconnect(ctx)
+
+	keys, err := internal.PrepareAPIKeys(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing API keys", err)
+	}
+	webhooks, deliveries, err := internal.PrepareWebhooks(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing webhooks", err)
+	}
+	outbox, err := internal.PrepareOutbox(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing outbox", err)
+	}
+
+	workCtx, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+
+	// The write services store every catalog change in the outbox, in the
+	// transaction of the change itself. Each entry is queued for the webhooks
+	// subscribed to it. An entry may be queued again if the relay stops before
+	// marking it published, the delivery IDs derived from the event ID make
+	// that a no-op.
+	go internal.RunOutbox(workCtx, outbox, func(ctx context.Context, ev internal.BookEvent) error {
+		ctx, cancel := context.WithTimeout(ctx, cfg.QueryTimeout)
+		defer cancel()
+		return internal.EnqueueDeliveries(ctx, webhooks, deliveries, ev)
+	})
+
+	// The queue is persistent: deliveries that fail are retried with
+	// exponential backoff, also across restarts
+	go internal.RunDeliveries(workCtx, webhooks, deliveries, &http.Client{Timeout: 10 * time.Second})
+
+	e := internal.NewServer("relay-service", logger)
+	// Behind nginx the client IP is taken from X-Forwarded-For
+	e.IPExtractor = internal.IPExtractor(cfg.TrustedProxies)
+	e.Server.RegisterOnShutdown(stopWork)
+
+	// Managing webhooks is reserved to admins
+	verifier := internal.NewTokenVerifier(cfg.JWTSecret, cfg.JWKSURL)
+	auth := internal.NewAuthenticator(keys, verifier, internal.Role(cfg.AnonymousRole), cfg.QueryTimeout)
+	limiter := internal.NewRateLimiter(cfg.WriteRateLimit)
+	// Every IP address is limited before its credentials are checked
+	ipLimiter := internal.NewRateLimiter(cfg.IPRateLimit)
+	api := e.Group("/api", ipLimiter.IPMiddleware(), auth.Authenticate, limiter.Middleware(), internal.RequireRole(internal.RoleAdmin))
+
+	api.POST("/webhooks", func(c echo.Context) error {
+		var body struct {
+			URL    string               `json:"url"`
+			Events []internal.EventType `json:"events"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		hook, err := internal.RegisterWebhook(ctx, webhooks, body.URL, body.Events, internal.CurrentPrincipal(c).Subject)
+		if errors.Is(err, internal.ErrInvalidWebhook) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to register webhook")
+		}
+
+		// The secret is only ever shown here
+		return c.JSON(http.StatusCreated, map[string]interface{}{
+			"id":     hook.ID,
+			"url":    hook.URL,
+			"events": hook.Events,
+			"secret": hook.Secret,
+		})
+	})
+
+	api.GET("/webhooks", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		hooks, err := internal.ListWebhooks(ctx, webhooks)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve webhooks")
+		}
+		return c.JSON(http.StatusOK, hooks)
+	})
+
+	api.DELETE("/webhooks/:id", func(c echo.Context) error {
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		err := internal.DeleteWebhook(ctx, webhooks, deliveries, c.Param("id"))
+		if errors.Is(err, internal.ErrWebhookNotFound) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Webhook not found"})
+		}
+		if err != nil {
+			return internal.DBError(c, err, "Failed to delete webhook")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"message": "Webhook deleted successfully"})
+	})
+
+	// Delivery log of a webhook, newest first, with every attempt
+	api.GET("/webhooks/:id/deliveries", func(c echo.Context) error {
+		limit := int64(50)
+		if v := c.QueryParam("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 1000 {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Limit must be between 1 and 1000"})
+			}
+			limit = int64(n)
+		}
+
+		ctx, cancel := internal.QueryContext(c, cfg.QueryTimeout)
+		defer cancel()
+
+		list, err := internal.ListDeliveries(ctx, deliveries, c.Param("id"), limit)
+		if err != nil {
+			return internal.DBError(c, err, "Failed to retrieve deliveries")
+		}
+		return c.JSON(http.StatusOK, list)
+	})
+
+	internal.Start(e, cfg.Addr())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CAPS-Cloud/exercises/internal"
+	"github.com/CAPS-Cloud/exercises/internal/config"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const usage = `Manage the roles of the frontend accounts.
+
+Usage:
+  user [config flags] roles <username> <role>...   replace the roles of a user
+  user [config flags] list                         show every user and their roles
+
+Roles are reader, librarian and admin. New accounts are readers. Access tokens
+already issued keep their roles until they expire.
+`
+
+func main() {
+	// The port is not used, but the shared configuration validates it
+	cfg, err := config.Load("user", 8080, os.Args[1:])
+	if err != nil {
+		internal.Fatal("Invalid configuration", err)
+	}
+	if len(cfg.Args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	client, ctx, cancel, err := internal.ConnectDB(cfg.DatabaseURI)
+	if err != nil {
+		internal.Fatal("Failed to connect to DB", err)
+	}
+	defer cancel()
+	defer client.Disconnect(ctx)
+
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.QueryTimeout)
+	defer cancel()
+
+	users, err := internal.PrepareUsers(ctx, client.Database(cfg.Database))
+	if err != nil {
+		internal.Fatal("Error preparing users", err)
+	}
+
+	switch cmd, args := cfg.Args[0], cfg.Args[1:]; {
+	case cmd == "roles" && len(args) >= 2:
+		roles, err := internal.ParseRoles(args[1:])
+		if err != nil {
+			internal.Fatal("Invalid role", err)
+		}
+		err = internal.SetUserRoles(ctx, users, args[0], roles)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			internal.Fatal("Failed to set roles", fmt.Errorf("no user %q", args[0]))
+		}
+		if err != nil {
+			internal.Fatal("Failed to set roles", err)
+		}
+		fmt.Printf("User %s now has the roles %s\n", args[0], strings.Join(args[1:], ","))
+
+	case cmd == "list" && len(args) == 0:
+		list, err := internal.ListUsers(ctx, users)
+		if err != nil {
+			internal.Fatal("Failed to list users", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tROLES\tCREATED")
+		for _, u := range list {
+			names := make([]string, len(u.Roles))
+			for i, r := range u.Roles {
+				names[i] = string(r)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", u.Username, strings.Join(names, ","), u.CreatedAt.Format(time.RFC3339))
+		}
+		w.Flush()
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
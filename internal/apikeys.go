@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeysCollection stores the API keys next to the books
+const APIKeysCollection = "apikeys"
+
+// APIKeyHeader carries the API key of a request
+const APIKeyHeader = "X-API-Key"
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+	ErrAPIKeyRevoked  = errors.New("API key revoked")
+)
+
+// DefaultAPIKeyRoles are granted to keys issued without roles, and to keys
+// issued before roles existed. They only allow reading, write access has to
+// be asked for when the key is issued.
+var DefaultAPIKeyRoles = []Role{RoleReader}
+
+// APIKey grants access to the API. Only the SHA-256 hash of the key is
+// stored, the key itself is shown once when it is issued.
+type APIKey struct {
+	ID         string     `bson:"id" json:"id"`
+	Name       string     `bson:"name" json:"name"`
+	Roles      []Role     `bson:"roles,omitempty" json:"roles"`
+	Hash       string     `bson:"hash" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// PrepareAPIKeys returns the API key collection, making sure keys are unique
+// and can be looked up by their hash
+func PrepareAPIKeys(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(APIKeysCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// IssueAPIKey creates a new key. The returned string is the only copy of the
+// key and has to be handed to the client.
+func IssueAPIKey(ctx context.Context, coll *mongo.Collection, name string, roles []Role) (string, *APIKey, error) {
+	if len(roles) == 0 {
+		roles = DefaultAPIKeyRoles
+	}
+
+	id, err := randomString(6)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key := "bk_" + id + "_" + secret
+
+	apiKey := &APIKey{
+		ID:        id,
+		Name:      name,
+		Roles:     roles,
+		Hash:      hashToken(key),
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := coll.InsertOne(ctx, apiKey); err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+// RevokeAPIKey disables a key. Revoking a key twice keeps the first date.
+func RevokeAPIKey(ctx context.Context, coll *mongo.Collection, id string) error {
+	result, err := coll.UpdateOne(ctx,
+		bson.M{"id": id},
+		bson.A{bson.M{"$set": bson.M{"revoked_at": bson.M{"$ifNull": bson.A{"$revoked_at", "$$NOW"}}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// ListAPIKeys returns every key, revoked ones included
+func ListAPIKeys(ctx context.Context, coll *mongo.Collection) ([]APIKey, error) {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err = cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// VerifyAPIKey looks the key up and records that it was used
+func VerifyAPIKey(ctx context.Context, coll *mongo.Collection, key string) (*APIKey, error) {
+	hash := hashToken(key)
+	var apiKey APIKey
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"hash": hash, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"last_used_at": time.Now().UTC()}},
+	).Decode(&apiKey)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Tell revoked keys apart from keys that never existed
+		count, err := coll.CountDocuments(ctx, bson.M{"hash": hash})
+		if err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, ErrAPIKeyRevoked
+		}
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+// hashToken returns the SHA-256 digest stored in place of API keys and
+// session tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n random bytes encoded for use in URLs and headers
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
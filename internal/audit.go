@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AuditCollection stores one record per change of the catalog. Records are
+// only ever inserted.
+const AuditCollection = "audit"
+
+// Actions recorded in the audit log
+const (
+	AuditCreate = "create"
+	AuditImport = "import"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// AuditEntry records who changed a book, when, and how
+type AuditEntry struct {
+	Time      time.Time `bson:"time" json:"time"`
+	Action    string    `bson:"action" json:"action"`
+	BookID    string    `bson:"book_id" json:"book_id"`
+	Actor     string    `bson:"actor" json:"actor"`
+	RequestID string    `bson:"request_id" json:"request_id"`
+	// Changes maps the changed fields of the book to their old and new value
+	Changes map[string]AuditChange `bson:"changes" json:"changes"`
+}
+
+// AuditChange is the old and new value of a field. Before is missing for
+// created books and After for deleted ones.
+type AuditChange struct {
+	Before interface{} `bson:"before,omitempty" json:"before,omitempty"`
+	After  interface{} `bson:"after,omitempty" json:"after,omitempty"`
+}
+
+// Actor is who made a change, in which request. It is recorded with the
+// change in the audit log and the revisions.
+type Actor struct {
+	Subject   string
+	RequestID string
+}
+
+// RequestActor returns the caller of the current request as actor
+func RequestActor(c echo.Context) Actor {
+	actor := Actor{
+		Subject:   AnonymousSubject,
+		RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if p := CurrentPrincipal(c); p != nil {
+		actor.Subject = p.Subject
+	}
+	return actor
+}
+
+// AuditFilter selects audit entries; zero fields match everything
+type AuditFilter struct {
+	BookID string
+	Actor  string
+	From   time.Time
+	To     time.Time
+	Limit  int64
+}
+
+// PrepareAudit returns the audit collection with the indexes used by the
+// filters of ListAudit
+func PrepareAudit(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(AuditCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// NewAuditEntry describes a change made by actor. before and after are the
+// stored documents, nil if the book did not exist before or does not exist
+// after the change.
+func NewAuditEntry(actor Actor, action, bookID string, before, after bson.M) AuditEntry {
+	return AuditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		BookID:    bookID,
+		Actor:     actor.Subject,
+		RequestID: actor.RequestID,
+		Changes:   diffBooks(before, after),
+	}
+}
+
+// WriteAudit appends entries to the audit log. Like Publish, it has to be
+// called in the transaction making the change, so no change is made without
+// its entry.
+func WriteAudit(ctx context.Context, coll *mongo.Collection, entries ...AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		docs[i] = entry
+	}
+	_, err := coll.InsertMany(ctx, docs)
+	return err
+}
+
+// ListAudit returns the matching entries, newest first
+func ListAudit(ctx context.Context, coll *mongo.Collection, f AuditFilter) ([]AuditEntry, error) {
+	filter := bson.M{}
+	if f.BookID != "" {
+		filter["book_id"] = f.BookID
+	}
+	if f.Actor != "" {
+		filter["actor"] = f.Actor
+	}
+	if !f.From.IsZero() || !f.To.IsZero() {
+		between := bson.M{}
+		if !f.From.IsZero() {
+			between["$gte"] = f.From
+		}
+		if !f.To.IsZero() {
+			between["$lt"] = f.To
+		}
+		filter["time"] = between
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}}).SetLimit(f.Limit)
+	cursor, err := coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// BookDocument converts a book to the form stored in MongoDB
+func BookDocument(book BookStore) bson.M {
+	raw, _ := bson.Marshal(book)
+	var doc bson.M
+	_ = bson.Unmarshal(raw, &doc)
+	return doc
+}
+
+// diffBooks returns the fields that differ between two documents
+func diffBooks(before, after bson.M) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for field, value := range before {
+		if field == "_id" {
+			continue
+		}
+		if other, ok := after[field]; !ok || !reflect.DeepEqual(value, other) {
+			changes[field] = AuditChange{Before: value, After: other}
+		}
+	}
+	for field, value := range after {
+		if _, ok := before[field]; !ok && field != "_id" {
+			changes[field] = AuditChange{After: value}
+		}
+	}
+	return changes
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// principalKey stores the authenticated caller in the echo context
+const principalKey = "principal"
+
+// Principal is the authenticated caller of an API request
+type Principal struct {
+	// Subject is the user name for tokens and "apikey:<id>" for API keys
+	Subject string
+	Roles   []Role
+}
+
+// AnonymousSubject identifies requests without credentials
+const AnonymousSubject = "anonymous"
+
+// CurrentPrincipal returns the caller resolved by Authenticate, or by the
+// session middleware in the frontend
+func CurrentPrincipal(c echo.Context) *Principal {
+	p, _ := c.Get(principalKey).(*Principal)
+	return p
+}
+
+// Authenticator accepts either a bearer token issued by the frontend or an
+// API key. Tokens are verified locally, without calling another service.
+type Authenticator struct {
+	keys      *mongo.Collection
+	verifier  *TokenVerifier
+	anonymous Role
+	timeout   time.Duration
+}
+
+// NewAuthenticator combines API keys and tokens. verifier may be nil, in
+// which case only API keys are accepted. Requests without credentials are
+// given the anonymous role, or rejected if it is empty or "none".
+func NewAuthenticator(keys *mongo.Collection, verifier *TokenVerifier, anonymous Role, timeout time.Duration) *Authenticator {
+	if anonymous == "none" {
+		anonymous = ""
+	}
+	return &Authenticator{keys: keys, verifier: verifier, anonymous: anonymous, timeout: timeout}
+}
+
+// Authenticate resolves the principal of the request. Invalid credentials are
+// answered with 401 and a revoked API key with 403. Whether the principal may
+// use the route is decided by RequireRole.
+func (a *Authenticator) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := QueryContext(c, a.timeout)
+		defer cancel()
+
+		var principal *Principal
+		if token, ok := bearerToken(c); ok {
+			if a.verifier == nil {
+				return unauthorized(c, "Bearer tokens are not accepted")
+			}
+			claims, err := a.verifier.Verify(ctx, token)
+			if err != nil {
+				Logger(c).Info("Rejected token", "error", err)
+				return unauthorized(c, "Invalid token")
+			}
+			principal = &Principal{Subject: claims.Subject, Roles: claims.Roles}
+		} else if key := c.Request().Header.Get(APIKeyHeader); key != "" {
+			apiKey, err := VerifyAPIKey(ctx, a.keys, key)
+			switch {
+			case errors.Is(err, ErrInvalidAPIKey):
+				return unauthorized(c, "Invalid API key")
+			case errors.Is(err, ErrAPIKeyRevoked):
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "API key revoked"})
+			case err != nil:
+				return DBError(c, err, "Failed to verify API key")
+			}
+			roles := apiKey.Roles
+			if len(roles) == 0 {
+				roles = DefaultAPIKeyRoles
+			}
+			principal = &Principal{Subject: "apikey:" + apiKey.ID, Roles: roles}
+		} else if a.anonymous != "" {
+			principal = &Principal{Subject: AnonymousSubject, Roles: []Role{a.anonymous}}
+		} else {
+			return unauthorized(c, "Missing credentials")
+		}
+
+		c.Set(principalKey, principal)
+		c.Set(loggerKey, Logger(c).With("principal", principal.Subject))
+		return next(c)
+	}
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+func unauthorized(c echo.Context, msg string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="bookstore"`)
+	return c.JSON(http.StatusUnauthorized, map[string]string{"error": msg})
+}
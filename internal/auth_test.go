@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const testSecret = "test-secret"
+
+// protectedRoutes has a route of every group the services protect, with
+// the role it requires
+var protectedRoutes = []struct {
+	service, method, path string
+	role                  Role
+}{
+	{"get", http.MethodGet, "/api/books", RoleReader},
+	{"get", http.MethodGet, "/api/members", RoleLibrarian},
+	{"get", http.MethodGet, "/api/audit", RoleAdmin},
+	{"post", http.MethodPost, "/api/books/b1/holds", RoleReader},
+	{"post", http.MethodPost, "/api/books", RoleLibrarian},
+	{"post", http.MethodPost, "/api/books/import", RoleAdmin},
+	{"put", http.MethodPut, "/api/books/b1", RoleLibrarian},
+	{"delete", http.MethodDelete, "/api/holds/h1", RoleReader},
+	{"delete", http.MethodDelete, "/api/books/b1", RoleAdmin},
+	{"relay", http.MethodGet, "/api/webhooks", RoleAdmin},
+}
+
+// apiKeyFound is the response of MongoDB to the lookup of a valid key
+func apiKeyFound(roles ...Role) []bson.D {
+	return []bson.D{mtest.CreateSuccessResponse(bson.E{Key: "value", Value: APIKey{ID: "k1", Roles: roles}})}
+}
+
+// apiKeyMissing is the response of MongoDB to the lookup of a key that is
+// revoked (stored) or was never issued
+func apiKeyMissing(stored bool) []bson.D {
+	var counts []bson.D
+	if stored {
+		counts = append(counts, bson.D{{Key: "n", Value: 1}})
+	}
+	return []bson.D{
+		mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}),
+		mtest.CreateCursorResponse(0, "test.apikeys", mtest.FirstBatch, counts...),
+	}
+}
+
+func TestAuthenticateRoleMatrix(t *testing.T) {
+	signer, err := NewTokenSigner(testSecret, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(role Role) string {
+		signed, _, err := signer.Sign("alice", []Role{role})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	credentials := []struct {
+		name   string
+		header string
+		value  string
+		// mongo are the responses to the API key lookup
+		mongo []bson.D
+		// role is granted to the caller, status is the answer to every
+		// route if the credentials are rejected
+		role   Role
+		status int
+	}{
+		{name: "anonymous", role: RoleReader},
+		{name: "reader token", header: echo.HeaderAuthorization, value: "Bearer " + token(RoleReader), role: RoleReader},
+		{name: "librarian token", header: echo.HeaderAuthorization, value: "Bearer " + token(RoleLibrarian), role: RoleLibrarian},
+		{name: "admin token", header: echo.HeaderAuthorization, value: "Bearer " + token(RoleAdmin), role: RoleAdmin},
+		{name: "invalid token", header: echo.HeaderAuthorization, value: "Bearer not-a-token", status: http.StatusUnauthorized},
+		{name: "reader key", header: APIKeyHeader, value: "bk_k1_reader", mongo: apiKeyFound(RoleReader), role: RoleReader},
+		{name: "librarian key", header: APIKeyHeader, value: "bk_k1_librarian", mongo: apiKeyFound(RoleLibrarian), role: RoleLibrarian},
+		{name: "admin key", header: APIKeyHeader, value: "bk_k1_admin", mongo: apiKeyFound(RoleAdmin), role: RoleAdmin},
+		{name: "key without roles", header: APIKeyHeader, value: "bk_k1_legacy", mongo: apiKeyFound(), role: RoleReader},
+		{name: "revoked key", header: APIKeyHeader, value: "bk_k1_revoked", mongo: apiKeyMissing(true), status: http.StatusForbidden},
+		{name: "invalid key", header: APIKeyHeader, value: "bk_k1_invalid", mongo: apiKeyMissing(false), status: http.StatusUnauthorized},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, cred := range credentials {
+		for _, route := range protectedRoutes {
+			mt.Run(cred.name+"/"+route.service+" "+route.method+" "+route.path, func(mt *mtest.T) {
+				mt.AddMockResponses(cred.mongo...)
+
+				e := echo.New()
+				auth := NewAuthenticator(mt.Coll, NewTokenVerifier(testSecret, ""), RoleReader, time.Second)
+				e.Group("/api", auth.Authenticate).Add(route.method, strings.TrimPrefix(route.path, "/api"), func(c echo.Context) error {
+					return c.NoContent(http.StatusOK)
+				}, RequireRole(route.role))
+
+				req := httptest.NewRequest(route.method, route.path, nil)
+				if cred.header != "" {
+					req.Header.Set(cred.header, cred.value)
+				}
+				rec := httptest.NewRecorder()
+				e.ServeHTTP(rec, req)
+
+				want := cred.status
+				if want == 0 {
+					want = http.StatusForbidden
+					if cred.role.Includes(route.role) {
+						want = http.StatusOK
+					}
+				}
+				if rec.Code != want {
+					mt.Errorf("status %d, want %d: %s", rec.Code, want, rec.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestAuthenticateWithoutAnonymousRole(t *testing.T) {
+	e := echo.New()
+	auth := NewAuthenticator(nil, nil, "none", time.Second)
+	e.GET("/api/books", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, auth.Authenticate, RequireRole(RoleReader))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/books", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireRoleWithoutPrincipal(t *testing.T) {
+	e := echo.New()
+	e.GET("/api/books", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, RequireRole(RoleReader))
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/books", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
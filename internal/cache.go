@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Headers of the response cache. Requests with any CacheBypassHeader value
+// are answered from the database and leave the cache untouched; CacheHeader
+// tells whether a response was a HIT, a MISS or a BYPASS.
+const (
+	CacheHeader       = "X-Cache"
+	CacheBypassHeader = "X-Cache-Bypass"
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "cache_requests_total",
+	Help: "Number of requests served by the response cache, by route and result (hit, miss, bypass).",
+}, []string{"route", "result"})
+
+// bookKeyPrefix starts the cache keys of single books. Every other key holds
+// a list, which may change with any book.
+const bookKeyPrefix = "book:"
+
+// BookKey is the cache key of a single book
+func BookKey(id string) string {
+	return bookKeyPrefix + id
+}
+
+// Cache is an LRU cache of responses kept in memory. Entries expire after
+// the TTL, so the cache also recovers from change events it missed.
+type Cache struct {
+	size int
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List // most recently used first
+	items map[string]*list.Element
+	// gen counts the invalidations, values loaded across one are not stored
+	gen uint64
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewCache holds up to size entries for at most ttl. It returns nil, which
+// disables caching, if size is zero.
+func NewCache(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{size: size, ttl: ttl, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns the value of key and the current generation
+func (c *Cache) get(key string, now time.Time) (interface{}, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false, c.gen
+	}
+	entry := el.Value.(*cacheEntry)
+	if now.After(entry.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false, c.gen
+	}
+	c.ll.MoveToFront(el)
+	return entry.value, true, c.gen
+}
+
+// set stores the value unless the cache was invalidated since gen
+func (c *Cache) set(key string, value interface{}, gen uint64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	entry := &cacheEntry{key: key, value: value, expires: now.Add(c.ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// InvalidateBook drops the book and every list, all of which may contain it
+func (c *Cache) InvalidateBook(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for key, el := range c.items {
+		if key == BookKey(id) || !strings.HasPrefix(key, bookKeyPrefix) {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+// Invalidate applies the change events until the channel is closed
+func (c *Cache) Invalidate(events <-chan BookEvent) {
+	for ev := range events {
+		c.InvalidateBook(ev.BookID)
+	}
+}
+
+// Fetch returns the cached value of key, or loads and caches it. Errors are
+// not cached. A nil cache always loads.
+func (c *Cache) Fetch(ec echo.Context, key string, load func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return load()
+	}
+	route := ec.Path()
+	if ec.Request().Header.Get(CacheBypassHeader) != "" {
+		ec.Response().Header().Set(CacheHeader, "BYPASS")
+		cacheRequests.WithLabelValues(route, "bypass").Inc()
+		return load()
+	}
+
+	value, ok, gen := c.get(key, time.Now())
+	if ok {
+		ec.Response().Header().Set(CacheHeader, "HIT")
+		cacheRequests.WithLabelValues(route, "hit").Inc()
+		return value, nil
+	}
+
+	ec.Response().Header().Set(CacheHeader, "MISS")
+	cacheRequests.WithLabelValues(route, "miss").Inc()
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.set(key, value, gen, time.Now())
+	return value, nil
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cached returns the keys of c that hold a value at now
+func cached(c *Cache, now time.Time, keys ...string) []string {
+	var found []string
+	for _, key := range keys {
+		if _, ok, _ := c.get(key, now); ok {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := NewCache(2, time.Minute)
+	now := time.Now()
+
+	c.set("a", 1, 0, now)
+	c.set("b", 2, 0, now)
+	// Reading a makes b the least recently used entry
+	if v, ok, _ := c.get("a", now); !ok || v != 1 {
+		t.Fatalf("get a = %v, %v", v, ok)
+	}
+	c.set("c", 3, 0, now)
+
+	if got := cached(c, now, "a", "b", "c"); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Errorf("cached %q, want [a c]", got)
+	}
+
+	// Setting a key again replaces its value without evicting
+	c.set("a", 4, 0, now)
+	if v, _, _ := c.get("a", now); v != 4 {
+		t.Errorf("a = %v, want 4", v)
+	}
+	if got := cached(c, now, "a", "c"); len(got) != 2 {
+		t.Errorf("cached %q, want [a c]", got)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := NewCache(2, time.Minute)
+	now := time.Now()
+	c.set("a", 1, 0, now)
+
+	if got := cached(c, now.Add(time.Minute), "a"); len(got) != 1 {
+		t.Error("entry expired before its TTL")
+	}
+	if got := cached(c, now.Add(time.Minute+time.Second), "a"); len(got) != 0 {
+		t.Error("entry outlived its TTL")
+	}
+	if c.ll.Len() != 0 || len(c.items) != 0 {
+		t.Error("expired entry not removed")
+	}
+}
+
+func TestCacheGeneration(t *testing.T) {
+	c := NewCache(10, time.Minute)
+	now := time.Now()
+
+	// A value loaded while the book changed is stale and must not be stored
+	_, _, gen := c.get("books", now)
+	c.InvalidateBook("1")
+	c.set("books", "stale", gen, now)
+	if got := cached(c, now, "books"); len(got) != 0 {
+		t.Error("value loaded across an invalidation was stored")
+	}
+
+	_, _, gen = c.get("books", now)
+	c.set("books", "fresh", gen, now)
+	if v, ok, _ := c.get("books", now); !ok || v != "fresh" {
+		t.Errorf("books = %v, %v; want fresh", v, ok)
+	}
+}
+
+func TestCacheInvalidateBook(t *testing.T) {
+	c := NewCache(10, time.Minute)
+	now := time.Now()
+	keys := []string{BookKey("1"), BookKey("2"), "books?page=1", "authors", "years"}
+	for _, key := range keys {
+		c.set(key, key, 0, now)
+	}
+
+	// Every list may contain the book, only the other books stay
+	c.InvalidateBook("1")
+	if got := cached(c, now, keys...); len(got) != 1 || got[0] != BookKey("2") {
+		t.Errorf("cached %q, want [%s]", got, BookKey("2"))
+	}
+
+	var nilCache *Cache
+	nilCache.InvalidateBook("1")
+}
+
+// fetch calls c.Fetch for key in a request with the headers and returns the
+// value, the X-Cache header of the response and the error
+func fetch(t *testing.T, c *Cache, key string, header http.Header, load func() (interface{}, error)) (interface{}, string, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	ec := echo.New().NewContext(req, rec)
+	ec.SetPath("/api/books")
+	value, err := c.Fetch(ec, key, load)
+	return value, rec.Header().Get(CacheHeader), err
+}
+
+func TestCacheFetch(t *testing.T) {
+	c := NewCache(10, time.Minute)
+	loads := 0
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+	bypass := http.Header{CacheBypassHeader: {"1"}}
+
+	for _, step := range []struct {
+		name   string
+		header http.Header
+		value  interface{}
+		result string
+	}{
+		{"first request loads", nil, 1, "MISS"},
+		{"second request is cached", nil, 1, "HIT"},
+		{"bypass loads", bypass, 2, "BYPASS"},
+		// The bypassing request did not replace the cached value
+		{"cache untouched by bypass", nil, 1, "HIT"},
+	} {
+		value, result, err := fetch(t, c, "books", step.header, load)
+		if err != nil || value != step.value || result != step.result {
+			t.Errorf("%s: Fetch = %v, %v, %s; want %v, %s", step.name, value, err, result, step.value, step.result)
+		}
+	}
+
+	// Errors are not cached
+	failed := errors.New("database down")
+	if _, _, err := fetch(t, c, "authors", nil, func() (interface{}, error) { return nil, failed }); !errors.Is(err, failed) {
+		t.Errorf("error %v, want %v", err, failed)
+	}
+	if value, result, _ := fetch(t, c, "authors", nil, load); value != 3 || result != "MISS" {
+		t.Errorf("after an error: %v, %s; want 3, MISS", value, result)
+	}
+
+	// A nil cache always loads and sets no header
+	var nilCache *Cache
+	if value, result, _ := fetch(t, nilCache, "books", nil, load); value != 4 || result != "" {
+		t.Errorf("nil cache: %v, %q; want 4 and no header", value, result)
+	}
+}
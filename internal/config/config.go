@@ -0,0 +1,530 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default values used when neither the config file, the environment nor the
+// command line provide a setting.
+const (
+	DefaultDatabase   = "exercise-1"
+	DefaultCollection = "information"
+
+	DefaultQueryTimeout = 5 * time.Second
+
+	DefaultTracingExporter = "none"
+
+	DefaultSessionTTL = 24 * time.Hour
+	DefaultTokenTTL   = time.Hour
+
+	DefaultAnonymousRole = "reader"
+
+	DefaultReadRateLimit  = 600
+	DefaultWriteRateLimit = 60
+	DefaultIPRateLimit    = 1200
+
+	DefaultTrashRetention = 30 * 24 * time.Hour
+
+	DefaultCacheSize = 1000
+	DefaultCacheTTL  = 30 * time.Second
+
+	DefaultIdempotencyTTL = 24 * time.Hour
+
+	DefaultLoanPeriod = 14 * 24 * time.Hour
+	DefaultHoldPeriod = 3 * 24 * time.Hour
+	DefaultMaxLoans   = 5
+	DefaultFinePerDay = 25
+)
+
+// Config holds the settings shared by every service
+type Config struct {
+	Port        int    `yaml:"port"`
+	DatabaseURI string `yaml:"database_uri"`
+	Database    string `yaml:"database"`
+	Collection  string `yaml:"collection"`
+
+	// QueryTimeout bounds every database operation issued while serving
+	// a request
+	QueryTimeout time.Duration `yaml:"query_timeout"`
+
+	// LogLevel is the minimum level written by the service logger
+	LogLevel slog.Level `yaml:"log_level"`
+
+	// TracingExporter selects where trace spans are sent: "none", "stdout"
+	// or "otlp" (configured by the standard OTEL_EXPORTER_OTLP_* variables)
+	TracingExporter string `yaml:"tracing_exporter"`
+
+	// SessionTTL is how long a frontend login stays valid
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// CookieSecure restricts the session cookie to HTTPS
+	CookieSecure bool `yaml:"cookie_secure"`
+
+	// JWTSecret signs and verifies access tokens with HS256 when set. It is
+	// deliberately not available as a flag.
+	JWTSecret string `yaml:"jwt_secret"`
+	// JWTKeyFiles are PEM encoded RSA keys the frontend signs tokens with
+	// (RS256). The first key signs, all of them are published in the JWKS.
+	JWTKeyFiles []string `yaml:"jwt_key_files"`
+	// JWKSURL is where the method services fetch the frontend's public keys
+	JWKSURL string `yaml:"jwks_url"`
+	// TokenTTL is the lifetime of an access token
+	TokenTTL time.Duration `yaml:"token_ttl"`
+
+	// AnonymousRole is granted to API requests without credentials: "reader"
+	// keeps the catalog public, "none" requires credentials for every request
+	AnonymousRole string `yaml:"anonymous_role"`
+
+	// ReadRateLimit and WriteRateLimit are the requests per minute a client
+	// may send to the read and the write endpoints; 0 disables the limit
+	ReadRateLimit  int `yaml:"read_rate_limit"`
+	WriteRateLimit int `yaml:"write_rate_limit"`
+	// IPRateLimit is the requests per minute an IP address may send to the
+	// API before its credentials are checked, so floods of invalid
+	// credentials are rejected without looking them up; 0 disables the limit
+	IPRateLimit int `yaml:"ip_rate_limit"`
+	// TrustedProxies are the address ranges (CIDR) of the proxies, i.e.,
+	// nginx, whose X-Forwarded-For header names the client. Requests from
+	// other addresses are attributed to the connecting address.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// TrashRetention is how long deleted books can be restored before the
+	// delete-service purges them
+	TrashRetention time.Duration `yaml:"trash_retention"`
+
+	// CacheSize is how many responses the get-service caches, 0 disables the
+	// cache. Cached responses expire after CacheTTL at the latest.
+	CacheSize int           `yaml:"cache_size"`
+	CacheTTL  time.Duration `yaml:"cache_ttl"`
+
+	// IdempotencyTTL is how long the post-service replays the response of a
+	// request to retries with the same Idempotency-Key
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+
+	// LoanPeriod is how long a book may be borrowed before it is overdue
+	LoanPeriod time.Duration `yaml:"loan_period"`
+	// HoldPeriod is how long a returned copy is kept for the next hold
+	HoldPeriod time.Duration `yaml:"hold_period"`
+	// MaxLoans is how many books a member may borrow at once unless their
+	// membership sets another limit
+	MaxLoans int `yaml:"max_loans"`
+	// FinePerDay is charged for every day a book is returned late, in cents
+	FinePerDay int `yaml:"fine_per_day"`
+
+	// Args holds the command line arguments left after the flags
+	Args []string `yaml:"-"`
+}
+
+// Load builds the configuration of a service. Settings are applied in the
+// following order, later sources overriding earlier ones:
+//
+//  1. built-in defaults (defaultPort and the Default* constants)
+//  2. the YAML file given by -config or CONFIG_FILE (optional)
+//  3. environment variables (PORT, DATABASE_URI, DATABASE_NAME, COLLECTION_NAME,
+//     QUERY_TIMEOUT, LOG_LEVEL, TRACING_EXPORTER, SESSION_TTL, COOKIE_SECURE,
+//     JWT_SECRET, JWT_KEY_FILES, JWKS_URL, TOKEN_TTL, ANONYMOUS_ROLE,
+//     READ_RATE_LIMIT, WRITE_RATE_LIMIT, IP_RATE_LIMIT, TRUSTED_PROXIES,
+//     TRASH_RETENTION, CACHE_SIZE, CACHE_TTL, IDEMPOTENCY_TTL, LOAN_PERIOD,
+//     HOLD_PERIOD, MAX_LOANS, FINE_PER_DAY)
+//  4. command line flags (-port, -database-uri, -database, -collection,
+//     -query-timeout, -log-level, -tracing-exporter, -session-ttl,
+//     -cookie-secure, -jwt-key-files, -jwks-url, -token-ttl, -anonymous-role,
+//     -read-rate-limit, -write-rate-limit, -ip-rate-limit, -trusted-proxies,
+//     -trash-retention, -cache-size, -cache-ttl, -idempotency-ttl,
+//     -loan-period, -hold-period, -max-loans, -fine-per-day)
+func Load(name string, defaultPort int, args []string) (*Config, error) {
+	cfg := &Config{
+		Port:       defaultPort,
+		Database:   DefaultDatabase,
+		Collection: DefaultCollection,
+
+		QueryTimeout:    DefaultQueryTimeout,
+		TracingExporter: DefaultTracingExporter,
+		SessionTTL:      DefaultSessionTTL,
+		TokenTTL:        DefaultTokenTTL,
+		AnonymousRole:   DefaultAnonymousRole,
+		ReadRateLimit:   DefaultReadRateLimit,
+		WriteRateLimit:  DefaultWriteRateLimit,
+		IPRateLimit:     DefaultIPRateLimit,
+		TrashRetention:  DefaultTrashRetention,
+		CacheSize:       DefaultCacheSize,
+		CacheTTL:        DefaultCacheTTL,
+		IdempotencyTTL:  DefaultIdempotencyTTL,
+		LoanPeriod:      DefaultLoanPeriod,
+		HoldPeriod:      DefaultHoldPeriod,
+		MaxLoans:        DefaultMaxLoans,
+		FinePerDay:      DefaultFinePerDay,
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("CONFIG_FILE"), "path to an optional YAML config file")
+	port := fs.Int("port", 0, "port the HTTP server listens on")
+	uri := fs.String("database-uri", "", "MongoDB connection URI")
+	database := fs.String("database", "", "MongoDB database name")
+	collection := fs.String("collection", "", "MongoDB collection holding the books")
+	queryTimeout := fs.Duration("query-timeout", 0, "deadline for each database operation")
+	var logLevel slog.Level
+	fs.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum log level (debug, info, warn, error)")
+	tracingExporter := fs.String("tracing-exporter", "", "trace exporter (none, stdout, otlp)")
+	sessionTTL := fs.Duration("session-ttl", 0, "lifetime of a frontend login")
+	cookieSecure := fs.Bool("cookie-secure", false, "only send the session cookie over HTTPS")
+	jwtKeyFiles := fs.String("jwt-key-files", "", "comma separated PEM files of the RSA token signing keys")
+	jwksURL := fs.String("jwks-url", "", "URL of the JWKS used to verify access tokens")
+	tokenTTL := fs.Duration("token-ttl", 0, "lifetime of an access token")
+	anonymousRole := fs.String("anonymous-role", "", "role of API requests without credentials (reader, none)")
+	readRateLimit := fs.Int("read-rate-limit", 0, "read requests per minute and client, 0 for no limit")
+	writeRateLimit := fs.Int("write-rate-limit", 0, "write requests per minute and client, 0 for no limit")
+	ipRateLimit := fs.Int("ip-rate-limit", 0, "API requests per minute and IP address, 0 for no limit")
+	trustedProxies := fs.String("trusted-proxies", "", "comma separated address ranges (CIDR) of proxies whose X-Forwarded-For is trusted")
+	trashRetention := fs.Duration("trash-retention", 0, "how long deleted books are kept before they are purged")
+	cacheSize := fs.Int("cache-size", 0, "number of cached responses, 0 disables the cache")
+	cacheTTL := fs.Duration("cache-ttl", 0, "how long a response is cached at most")
+	idempotencyTTL := fs.Duration("idempotency-ttl", 0, "how long responses are replayed for retries with the same Idempotency-Key")
+	loanPeriod := fs.Duration("loan-period", 0, "how long a book may be borrowed")
+	holdPeriod := fs.Duration("hold-period", 0, "how long a copy is kept for a hold")
+	maxLoans := fs.Int("max-loans", 0, "books a member may borrow at once")
+	finePerDay := fs.Int("fine-per-day", 0, "fine per day a book is returned late, in cents")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		if err := cfg.loadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	// Only flags given explicitly override the other sources
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "database-uri":
+			cfg.DatabaseURI = *uri
+		case "database":
+			cfg.Database = *database
+		case "collection":
+			cfg.Collection = *collection
+		case "query-timeout":
+			cfg.QueryTimeout = *queryTimeout
+		case "log-level":
+			cfg.LogLevel = logLevel
+		case "tracing-exporter":
+			cfg.TracingExporter = *tracingExporter
+		case "session-ttl":
+			cfg.SessionTTL = *sessionTTL
+		case "cookie-secure":
+			cfg.CookieSecure = *cookieSecure
+		case "jwt-key-files":
+			cfg.JWTKeyFiles = splitList(*jwtKeyFiles)
+		case "jwks-url":
+			cfg.JWKSURL = *jwksURL
+		case "token-ttl":
+			cfg.TokenTTL = *tokenTTL
+		case "anonymous-role":
+			cfg.AnonymousRole = *anonymousRole
+		case "read-rate-limit":
+			cfg.ReadRateLimit = *readRateLimit
+		case "write-rate-limit":
+			cfg.WriteRateLimit = *writeRateLimit
+		case "ip-rate-limit":
+			cfg.IPRateLimit = *ipRateLimit
+		case "trusted-proxies":
+			cfg.TrustedProxies = splitList(*trustedProxies)
+		case "trash-retention":
+			cfg.TrashRetention = *trashRetention
+		case "cache-size":
+			cfg.CacheSize = *cacheSize
+		case "cache-ttl":
+			cfg.CacheTTL = *cacheTTL
+		case "idempotency-ttl":
+			cfg.IdempotencyTTL = *idempotencyTTL
+		case "loan-period":
+			cfg.LoanPeriod = *loanPeriod
+		case "hold-period":
+			cfg.HoldPeriod = *holdPeriod
+		case "max-loans":
+			cfg.MaxLoans = *maxLoans
+		case "fine-per-day":
+			cfg.FinePerDay = *finePerDay
+		}
+	})
+
+	cfg.Args = fs.Args()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("config: parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	if v := os.Getenv("PORT"); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid PORT %q", v)
+		}
+		c.Port = port
+	}
+	if v := os.Getenv("DATABASE_URI"); v != "" {
+		c.DatabaseURI = v
+	}
+	if v := os.Getenv("DATABASE_NAME"); v != "" {
+		c.Database = v
+	}
+	if v := os.Getenv("COLLECTION_NAME"); v != "" {
+		c.Collection = v
+	}
+	if v := os.Getenv("QUERY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid QUERY_TIMEOUT %q", v)
+		}
+		c.QueryTimeout = d
+	}
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := c.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("config: invalid LOG_LEVEL %q", v)
+		}
+	}
+	if v := os.Getenv("TRACING_EXPORTER"); v != "" {
+		c.TracingExporter = v
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid SESSION_TTL %q", v)
+		}
+		c.SessionTTL = d
+	}
+	if v := os.Getenv("COOKIE_SECURE"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid COOKIE_SECURE %q", v)
+		}
+		c.CookieSecure = b
+	}
+	if v := os.Getenv("JWT_SECRET"); v != "" {
+		c.JWTSecret = v
+	}
+	if v := os.Getenv("JWT_KEY_FILES"); v != "" {
+		c.JWTKeyFiles = splitList(v)
+	}
+	if v := os.Getenv("JWKS_URL"); v != "" {
+		c.JWKSURL = v
+	}
+	if v := os.Getenv("TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid TOKEN_TTL %q", v)
+		}
+		c.TokenTTL = d
+	}
+	if v := os.Getenv("ANONYMOUS_ROLE"); v != "" {
+		c.AnonymousRole = v
+	}
+	if v := os.Getenv("READ_RATE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid READ_RATE_LIMIT %q", v)
+		}
+		c.ReadRateLimit = n
+	}
+	if v := os.Getenv("WRITE_RATE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid WRITE_RATE_LIMIT %q", v)
+		}
+		c.WriteRateLimit = n
+	}
+	if v := os.Getenv("IP_RATE_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid IP_RATE_LIMIT %q", v)
+		}
+		c.IPRateLimit = n
+	}
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		c.TrustedProxies = splitList(v)
+	}
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid TRASH_RETENTION %q", v)
+		}
+		c.TrashRetention = d
+	}
+	if v := os.Getenv("CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid CACHE_SIZE %q", v)
+		}
+		c.CacheSize = n
+	}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid CACHE_TTL %q", v)
+		}
+		c.CacheTTL = d
+	}
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid IDEMPOTENCY_TTL %q", v)
+		}
+		c.IdempotencyTTL = d
+	}
+	if v := os.Getenv("LOAN_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid LOAN_PERIOD %q", v)
+		}
+		c.LoanPeriod = d
+	}
+	if v := os.Getenv("HOLD_PERIOD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid HOLD_PERIOD %q", v)
+		}
+		c.HoldPeriod = d
+	}
+	if v := os.Getenv("MAX_LOANS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid MAX_LOANS %q", v)
+		}
+		c.MaxLoans = n
+	}
+	if v := os.Getenv("FINE_PER_DAY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("config: invalid FINE_PER_DAY %q", v)
+		}
+		c.FinePerDay = n
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d out of range", c.Port))
+	}
+	switch {
+	case c.DatabaseURI == "":
+		errs = append(errs, errors.New("DATABASE_URI not set"))
+	case !strings.HasPrefix(c.DatabaseURI, "mongodb://") && !strings.HasPrefix(c.DatabaseURI, "mongodb+srv://"):
+		errs = append(errs, errors.New("database URI must start with mongodb:// or mongodb+srv://"))
+	}
+	if c.Database == "" || strings.ContainsAny(c.Database, `/\. "$`) {
+		errs = append(errs, fmt.Errorf("invalid database name %q", c.Database))
+	}
+	if c.Collection == "" || strings.Contains(c.Collection, "$") || strings.HasPrefix(c.Collection, "system.") {
+		errs = append(errs, fmt.Errorf("invalid collection name %q", c.Collection))
+	}
+	if c.QueryTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("query timeout must be positive, got %s", c.QueryTimeout))
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, fmt.Errorf("session TTL must be positive, got %s", c.SessionTTL))
+	}
+	if c.TokenTTL <= 0 {
+		errs = append(errs, fmt.Errorf("token TTL must be positive, got %s", c.TokenTTL))
+	}
+	if c.JWTSecret != "" && len(c.JWTSecret) < 32 {
+		errs = append(errs, errors.New("JWT secret must be at least 32 characters long"))
+	}
+	if c.TrashRetention <= 0 {
+		errs = append(errs, fmt.Errorf("trash retention must be positive, got %s", c.TrashRetention))
+	}
+	if c.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("cache size must not be negative, got %d", c.CacheSize))
+	}
+	if c.CacheTTL <= 0 {
+		errs = append(errs, fmt.Errorf("cache TTL must be positive, got %s", c.CacheTTL))
+	}
+	if c.IdempotencyTTL <= 0 {
+		errs = append(errs, fmt.Errorf("idempotency TTL must be positive, got %s", c.IdempotencyTTL))
+	}
+	if c.LoanPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("loan period must be positive, got %s", c.LoanPeriod))
+	}
+	if c.HoldPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("hold period must be positive, got %s", c.HoldPeriod))
+	}
+	if c.MaxLoans < 1 {
+		errs = append(errs, fmt.Errorf("max loans must be at least 1, got %d", c.MaxLoans))
+	}
+	if c.FinePerDay < 0 {
+		errs = append(errs, fmt.Errorf("fine per day must not be negative, got %d", c.FinePerDay))
+	}
+	if c.ReadRateLimit < 0 || c.WriteRateLimit < 0 || c.IPRateLimit < 0 {
+		errs = append(errs, errors.New("rate limits must not be negative"))
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid trusted proxy range %q", cidr))
+		}
+	}
+	switch c.AnonymousRole {
+	case "none", "reader":
+	default:
+		errs = append(errs, fmt.Errorf("anonymous role must be reader or none, got %q", c.AnonymousRole))
+	}
+	switch c.TracingExporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("unknown tracing exporter %q", c.TracingExporter))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	return nil
+}
+
+// splitList splits a comma separated setting, ignoring empty entries
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// Addr returns the address the HTTP server binds to
+func (c *Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
@@ -0,0 +1,208 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a YAML config file and returns its path
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, `
+database_uri: mongodb://file:27017
+database: from-file
+collection: from-file
+query_timeout: 7s
+cache_size: 10
+`)
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		// want checks the settings of the loaded config
+		want func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"DATABASE_URI": "mongodb://env:27017"},
+			want: func(t *testing.T, cfg *Config) {
+				if cfg.Port != 8081 || cfg.Database != DefaultDatabase || cfg.QueryTimeout != DefaultQueryTimeout ||
+					cfg.CacheSize != DefaultCacheSize || cfg.ReadRateLimit != DefaultReadRateLimit {
+					t.Errorf("defaults not applied: %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "file overrides defaults",
+			args: []string{"-config", file},
+			want: func(t *testing.T, cfg *Config) {
+				if cfg.DatabaseURI != "mongodb://file:27017" || cfg.Database != "from-file" ||
+					cfg.QueryTimeout != 7*time.Second || cfg.CacheSize != 10 {
+					t.Errorf("file not applied: %+v", cfg)
+				}
+				// Settings missing in the file keep their default
+				if cfg.Port != 8081 || cfg.CacheTTL != DefaultCacheTTL {
+					t.Errorf("defaults lost: %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "file from CONFIG_FILE",
+			env:  map[string]string{"CONFIG_FILE": file},
+			want: func(t *testing.T, cfg *Config) {
+				if cfg.Database != "from-file" {
+					t.Errorf("database %q, want from-file", cfg.Database)
+				}
+			},
+		},
+		{
+			name: "environment overrides file",
+			env:  map[string]string{"DATABASE_NAME": "from-env", "QUERY_TIMEOUT": "9s", "TRUSTED_PROXIES": "10.0.0.1/32, 10.0.0.2/32"},
+			args: []string{"-config", file},
+			want: func(t *testing.T, cfg *Config) {
+				if cfg.Database != "from-env" || cfg.QueryTimeout != 9*time.Second {
+					t.Errorf("environment not applied: %+v", cfg)
+				}
+				if cfg.Collection != "from-file" || cfg.CacheSize != 10 {
+					t.Errorf("file settings lost: %+v", cfg)
+				}
+				if len(cfg.TrustedProxies) != 2 || cfg.TrustedProxies[1] != "10.0.0.2/32" {
+					t.Errorf("trusted proxies %q", cfg.TrustedProxies)
+				}
+			},
+		},
+		{
+			name: "flags override environment",
+			env:  map[string]string{"DATABASE_NAME": "from-env", "PORT": "9000"},
+			args: []string{"-config", file, "-database", "from-flag", "-cache-size", "0", "serve"},
+			want: func(t *testing.T, cfg *Config) {
+				if cfg.Database != "from-flag" || cfg.CacheSize != 0 {
+					t.Errorf("flags not applied: %+v", cfg)
+				}
+				if cfg.Port != 9000 || cfg.Collection != "from-file" {
+					t.Errorf("other sources lost: %+v", cfg)
+				}
+				if len(cfg.Args) != 1 || cfg.Args[0] != "serve" {
+					t.Errorf("args %q, want [serve]", cfg.Args)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Variables of the environment running the tests must not leak in
+			for _, name := range []string{"CONFIG_FILE", "PORT", "DATABASE_URI", "DATABASE_NAME", "QUERY_TIMEOUT", "CACHE_SIZE", "TRUSTED_PROXIES"} {
+				t.Setenv(name, "")
+			}
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			cfg, err := Load("test", 8081, tc.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.want(t, cfg)
+		})
+	}
+}
+
+func TestLoadInvalidSources(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{"environment", map[string]string{"QUERY_TIMEOUT": "soon"}, nil, "invalid QUERY_TIMEOUT"},
+		{"flag", nil, []string{"-max-loans", "many"}, "invalid value"},
+		{"unknown file setting", nil, []string{"-config", writeConfig(t, "databse: typo\n")}, "field databse not found"},
+		{"missing file", nil, []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, "no such file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("DATABASE_URI", "mongodb://env:27017")
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			_, err := Load("test", 8081, tc.args)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := &Config{
+		Port:            70000,
+		DatabaseURI:     "postgres://db",
+		Database:        "a.b",
+		Collection:      "system.books",
+		QueryTimeout:    0,
+		SessionTTL:      time.Hour,
+		TokenTTL:        time.Hour,
+		JWTSecret:       "short",
+		AnonymousRole:   "admin",
+		ReadRateLimit:   -1,
+		TrustedProxies:  []string{"nginx"},
+		TrashRetention:  time.Hour,
+		CacheTTL:        time.Second,
+		IdempotencyTTL:  time.Hour,
+		LoanPeriod:      time.Hour,
+		HoldPeriod:      time.Hour,
+		MaxLoans:        0,
+		FinePerDay:      -5,
+		TracingExporter: "zipkin",
+	}
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+
+	want := []string{
+		"port 70000 out of range",
+		"database URI must start with mongodb://",
+		`invalid database name "a.b"`,
+		`invalid collection name "system.books"`,
+		"query timeout must be positive",
+		"JWT secret must be at least 32 characters long",
+		"max loans must be at least 1",
+		"fine per day must not be negative",
+		"rate limits must not be negative",
+		`invalid trusted proxy range "nginx"`,
+		`anonymous role must be reader or none, got "admin"`,
+		`unknown tracing exporter "zipkin"`,
+	}
+	// errors.Join puts every error on a line of its own
+	lines := strings.Split(strings.TrimPrefix(err.Error(), "config: "), "\n")
+	if len(lines) != len(want) {
+		t.Errorf("got %d errors, want %d:\n%v", len(lines), len(want), err)
+	}
+	for _, msg := range want {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error is missing %q", msg)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("DATABASE_URI", "")
+	if _, err := Load("test", 8081, nil); err == nil || !strings.Contains(err.Error(), "DATABASE_URI not set") {
+		t.Errorf("error %v, want DATABASE_URI not set", err)
+	}
+	if _, err := Load("test", 8081, []string{"-database-uri", "mongodb://localhost:27017"}); err != nil {
+		t.Errorf("defaults are invalid: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StatusClientClosedRequest is the (non-standard) status nginx uses when the
+// client went away before a response was written
+const StatusClientClosedRequest = 499
+
+// QueryContext derives the context for a database operation from the request
+// context, so a query stops as soon as the client disconnects or the
+// per-operation deadline expires
+func QueryContext(c echo.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request().Context(), timeout)
+}
+
+// DBError writes the JSON response for a failed database operation. Deadlines
+// are reported as 504, cancellations by the client are only logged and any
+// other error becomes a 500 with the given message.
+func DBError(c echo.Context, err error, msg string) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		return c.JSON(http.StatusGatewayTimeout, map[string]string{"error": "Database operation timed out"})
+	case errors.Is(err, context.Canceled):
+		Logger(c).Warn("Request cancelled by client", "method", c.Request().Method, "route", c.Path(), "error", err)
+		return c.NoContent(StatusClientClosedRequest)
+	}
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": msg})
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventType tells what happened to a book
+type EventType string
+
+const (
+	BookCreated EventType = "BookCreated"
+	BookUpdated EventType = "BookUpdated"
+	BookDeleted EventType = "BookDeleted"
+)
+
+// BookEvent is a change of the catalog. Book is the book after the change,
+// nil for deleted books. ID is only set on events from the outbox.
+type BookEvent struct {
+	ID     string     `bson:"id,omitempty" json:"id,omitempty"`
+	Type   EventType  `bson:"type" json:"type"`
+	BookID string     `bson:"book_id" json:"book_id"`
+	Book   *BookStore `bson:"book,omitempty" json:"book,omitempty"`
+	Time   time.Time  `bson:"time" json:"time"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind before
+// events are dropped for it
+const subscriberBuffer = 64
+
+// Broadcaster hands every published event to all subscribers. Publishing
+// never blocks: a subscriber that does not keep up misses events.
+type Broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan BookEvent]struct{}
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{subs: map[chan BookEvent]struct{}{}}
+}
+
+// Subscribe returns a channel receiving the events published from now on.
+// The returned function ends the subscription and closes the channel.
+func (b *Broadcaster) Subscribe() (<-chan BookEvent, func()) {
+	ch := make(chan BookEvent, subscriberBuffer)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends the event to every subscriber
+func (b *Broadcaster) Publish(ev BookEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			slog.Warn("Dropped event for slow subscriber", "type", ev.Type, "book_id", ev.BookID)
+		}
+	}
+}
+
+// changeEvent is the part of a MongoDB change stream event we use
+type changeEvent struct {
+	OperationType     string   `bson:"operationType"`
+	FullDocument      bson.Raw `bson:"fullDocument"`
+	UpdateDescription struct {
+		UpdatedFields bson.Raw `bson:"updatedFields"`
+		RemovedFields []string `bson:"removedFields"`
+	} `bson:"updateDescription"`
+}
+
+// watchRetryDelay is the pause before the change stream is reopened
+const watchRetryDelay = 5 * time.Second
+
+// WatchBooks publishes the changes of the book collection until ctx is done.
+// It needs MongoDB to run as a replica set, which change streams require.
+// The stream is reopened after errors, resuming after the last event seen.
+func WatchBooks(ctx context.Context, coll *mongo.Collection, b *Broadcaster) {
+	watchEvents(ctx, coll, mongo.Pipeline{}, bookEvent, b)
+}
+
+// WatchOutbox publishes the events the write services add to the outbox
+// until ctx is done. Unlike RunOutbox, which hands every entry to one relay,
+// every watcher sees every event.
+func WatchOutbox(ctx context.Context, outbox *mongo.Collection, b *Broadcaster) {
+	inserts := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	watchEvents(ctx, outbox, inserts, outboxEvent, b)
+}
+
+// watchEvents publishes the changes of coll that convert turns into events,
+// reopening the stream after errors
+func watchEvents(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, convert func(changeEvent) (BookEvent, bool), b *Broadcaster) {
+	var resumeToken bson.Raw
+	for {
+		err := watch(ctx, coll, pipeline, convert, b, &resumeToken)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Change stream failed, reopening", "error", err, "retry_in", watchRetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+func watch(ctx context.Context, coll *mongo.Collection, pipeline mongo.Pipeline, convert func(changeEvent) (BookEvent, bool), b *Broadcaster, resumeToken *bson.Raw) error {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if *resumeToken != nil {
+		opts.SetResumeAfter(*resumeToken)
+	}
+	stream, err := coll.Watch(ctx, pipeline, opts)
+	if err != nil {
+		var cmdErr mongo.CommandError
+		// The resume token is too old, start from the current position
+		if errors.As(err, &cmdErr) && cmdErr.HasErrorLabel("NonResumableChangeStreamError") {
+			*resumeToken = nil
+		}
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		*resumeToken = stream.ResumeToken()
+
+		var change changeEvent
+		if err := stream.Decode(&change); err != nil {
+			slog.Error("Failed to decode change event", "error", err)
+			continue
+		}
+		if ev, ok := convert(change); ok {
+			b.Publish(ev)
+		}
+	}
+	return stream.Err()
+}
+
+// bookEvent converts a change stream event. Soft deletes and restores are
+// updates of deleted_at in MongoDB, but deletions and creations for
+// subscribers. Purging removes books that were already deleted, so actual
+// deletes are not published.
+func bookEvent(change changeEvent) (BookEvent, bool) {
+	ev := BookEvent{Time: time.Now().UTC()}
+
+	switch change.OperationType {
+	case "insert":
+		ev.Type = BookCreated
+	case "update", "replace":
+		ev.Type = BookUpdated
+		if _, err := change.UpdateDescription.UpdatedFields.LookupErr("deleted_at"); err == nil {
+			ev.Type = BookDeleted
+		}
+		for _, field := range change.UpdateDescription.RemovedFields {
+			if field == "deleted_at" {
+				ev.Type = BookCreated
+			}
+		}
+	default:
+		return ev, false
+	}
+
+	// The document is missing if the book was removed before it was looked up
+	if change.FullDocument == nil {
+		return ev, false
+	}
+	var book BookStore
+	if err := bson.Unmarshal(change.FullDocument, &book); err != nil {
+		slog.Error("Failed to decode changed book", "error", err)
+		return ev, false
+	}
+	ev.BookID = book.ID
+	if ev.Type != BookDeleted {
+		ev.Book = &book
+	}
+	return ev, true
+}
+
+// outboxEvent returns the event of a new outbox entry
+func outboxEvent(change changeEvent) (BookEvent, bool) {
+	if change.FullDocument == nil {
+		return BookEvent{}, false
+	}
+	var entry OutboxEntry
+	if err := bson.Unmarshal(change.FullDocument, &entry); err != nil {
+		slog.Error("Failed to decode outbox entry", "error", err)
+		return BookEvent{}, false
+	}
+	return entry.Event, true
+}
+
+// StartOutboxFeed watches the outbox in the background and returns the
+// broadcaster its events are published on
+func StartOutboxFeed(ctx context.Context, outbox *mongo.Collection) *Broadcaster {
+	b := NewBroadcaster()
+	go WatchOutbox(ctx, outbox, b)
+	return b
+}
+
+// StartChangeFeed watches the book collection in the background and returns
+// the broadcaster its events are published on
+func StartChangeFeed(ctx context.Context, coll *mongo.Collection) *Broadcaster {
+	b := NewBroadcaster()
+	go WatchBooks(ctx, coll, b)
+	return b
+}
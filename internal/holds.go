@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections of the holds and of the notifications sent to borrowers
+const (
+	HoldsCollection         = "holds"
+	NotificationsCollection = "notifications"
+)
+
+// Hold states. A hold waits in the queue of its book until a copy is kept
+// for it, is then ready for pickup until it expires and ends fulfilled by a
+// checkout, cancelled or expired.
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+)
+
+// NotificationHoldReady tells a borrower that a copy is kept for their hold
+const NotificationHoldReady = "hold_ready"
+
+// holdExpiryInterval is how often ready holds are checked for expiry
+const holdExpiryInterval = time.Minute
+
+var (
+	ErrHoldNotFound   = errors.New("hold not found")
+	ErrHoldExists     = errors.New("hold already placed")
+	ErrCopyAvailable  = errors.New("copy available")
+	errHoldNotExpired = errors.New("no expired hold")
+)
+
+// Hold is a borrower's place in the queue of a book. Active is set while the
+// hold waits or is ready, a borrower has at most one active hold per book.
+type Hold struct {
+	ID        string     `bson:"id" json:"id"`
+	BookID    string     `bson:"book_id" json:"book_id"`
+	Borrower  string     `bson:"borrower" json:"borrower"`
+	Status    string     `bson:"status" json:"status"`
+	Active    bool       `bson:"active" json:"-"`
+	PlacedAt  time.Time  `bson:"placed_at" json:"placed_at"`
+	ReadyAt   *time.Time `bson:"ready_at,omitempty" json:"ready_at,omitempty"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	ClosedAt  *time.Time `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+	// Position is the place of a waiting hold in the queue, starting at 1
+	Position int `bson:"-" json:"position,omitempty"`
+}
+
+// HoldFilter selects holds, empty fields match every hold
+type HoldFilter struct {
+	BookID   string
+	Borrower string
+	// Active restricts the list to waiting and ready holds
+	Active bool
+}
+
+// Notification is a message to a borrower
+type Notification struct {
+	ID        string    `bson:"id" json:"id"`
+	Recipient string    `bson:"recipient" json:"recipient"`
+	Type      string    `bson:"type" json:"type"`
+	BookID    string    `bson:"book_id" json:"book_id"`
+	HoldID    string    `bson:"hold_id,omitempty" json:"hold_id,omitempty"`
+	Message   string    `bson:"message" json:"message"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+func prepareHolds(ctx context.Context, db *mongo.Database) (*mongo.Collection, *mongo.Collection, error) {
+	holds := db.Collection(HoldsCollection)
+	_, err := holds.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "borrower", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"active": true}),
+		},
+		{Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "status", Value: 1}, {Key: "placed_at", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notifications := db.Collection(NotificationsCollection)
+	_, err = notifications.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "recipient", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return holds, notifications, nil
+}
+
+// PlaceHold queues borrower for the book. Holds can only be placed while
+// every copy is taken. It returns mongo.ErrNoDocuments if the book does not
+// exist, ErrCopyAvailable if a copy can be checked out right away and
+// ErrHoldExists if the borrower already holds the book. The borrower must be
+// an active member, else ErrMemberNotFound or ErrMemberInactive is returned.
+func (circ *Circulation) PlaceHold(ctx context.Context, bookID, borrower string) (*Hold, error) {
+	id, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	hold := &Hold{
+		ID:       id,
+		BookID:   bookID,
+		Borrower: borrower,
+		Status:   HoldWaiting,
+		Active:   true,
+		PlacedAt: time.Now().UTC(),
+	}
+
+	err = circ.transaction(ctx, func(ctx mongo.SessionContext) error {
+		if _, err := circ.checkMember(ctx, borrower); err != nil {
+			return err
+		}
+		var book BookStore
+		if err := circ.Books.FindOne(ctx, NotDeleted(bson.M{"id": bookID})).Decode(&book); err != nil {
+			return err
+		}
+		if book.Available() > 0 {
+			return ErrCopyAvailable
+		}
+		if _, err := circ.Holds.InsertOne(ctx, hold); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return ErrHoldExists
+			}
+			return err
+		}
+
+		ahead, err := circ.Holds.CountDocuments(ctx, bson.M{
+			"book_id":   bookID,
+			"status":    HoldWaiting,
+			"placed_at": bson.M{"$lt": hold.PlacedAt},
+		})
+		hold.Position = int(ahead) + 1
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// CancelHold cancels an active hold. The copy kept for a ready hold goes to
+// the next one in the queue. If borrower is set, only their holds can be
+// cancelled. It returns ErrHoldNotFound if there is no such active hold.
+func (circ *Circulation) CancelHold(ctx context.Context, id, borrower string) (*Hold, error) {
+	filter := bson.M{"id": id, "active": true}
+	if borrower != "" {
+		filter["borrower"] = borrower
+	}
+	return circ.closeHold(ctx, filter, HoldCancelled, ErrHoldNotFound)
+}
+
+// closeHold ends the hold matching filter with status, releasing its copy if
+// it was ready. notFound is returned if no hold matches.
+func (circ *Circulation) closeHold(ctx context.Context, filter bson.M, status string, notFound error) (*Hold, error) {
+	var hold *Hold
+	err := circ.transaction(ctx, func(ctx mongo.SessionContext) error {
+		var err error
+		hold, err = circ.endHold(ctx, filter, status, notFound)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// endHold is closeHold without its transaction. It has to be called in a
+// transaction.
+func (circ *Circulation) endHold(ctx context.Context, filter bson.M, status string, notFound error) (*Hold, error) {
+	var hold Hold
+	err := circ.Holds.FindOneAndUpdate(ctx, filter,
+		bson.M{
+			"$set":   bson.M{"status": status, "active": false, "closed_at": time.Now().UTC()},
+			"$unset": bson.M{"expires_at": ""},
+		},
+	).Decode(&hold)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hold.Status == HoldReady {
+		if err := circ.releaseCopy(ctx, hold.BookID, "on_hold"); err != nil {
+			return nil, err
+		}
+	}
+	hold.Status = status
+	hold.Active = false
+	return &hold, nil
+}
+
+// fulfilHold closes the ready hold of borrower on the book, whose copy is
+// then checked out to them. It has to be called in a transaction.
+func (circ *Circulation) fulfilHold(ctx context.Context, bookID, borrower string) (bool, error) {
+	result, err := circ.Holds.UpdateOne(ctx,
+		bson.M{"book_id": bookID, "borrower": borrower, "status": HoldReady},
+		bson.M{
+			"$set":   bson.M{"status": HoldFulfilled, "active": false, "closed_at": time.Now().UTC()},
+			"$unset": bson.M{"expires_at": ""},
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// promoteHold makes the oldest waiting hold on the book ready for pickup
+// until HoldPeriod has passed and notifies its borrower. It returns false if
+// nobody is waiting. It has to be called in a transaction.
+func (circ *Circulation) promoteHold(ctx context.Context, bookID string) (bool, error) {
+	now := time.Now().UTC()
+	expires := now.Add(circ.HoldPeriod)
+	var hold Hold
+	err := circ.Holds.FindOneAndUpdate(ctx,
+		bson.M{"book_id": bookID, "status": HoldWaiting},
+		bson.M{"$set": bson.M{"status": HoldReady, "ready_at": now, "expires_at": expires}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "placed_at", Value: 1}}),
+	).Decode(&hold)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	id, err := randomString(8)
+	if err != nil {
+		return false, err
+	}
+	_, err = circ.Notifications.InsertOne(ctx, Notification{
+		ID:        id,
+		Recipient: hold.Borrower,
+		Type:      NotificationHoldReady,
+		BookID:    bookID,
+		HoldID:    hold.ID,
+		Message:   fmt.Sprintf("A copy of %s is ready for pickup until %s", bookID, expires.Format(time.RFC1123)),
+		CreatedAt: now,
+	})
+	return err == nil, err
+}
+
+// ExpireHolds ends the ready holds that were not picked up in time and
+// passes their copies on. It returns the number of expired holds.
+func (circ *Circulation) ExpireHolds(ctx context.Context) (int, error) {
+	for n := 0; ; n++ {
+		_, err := circ.closeHold(ctx,
+			bson.M{"status": HoldReady, "expires_at": bson.M{"$lt": time.Now().UTC()}},
+			HoldExpired, errHoldNotExpired)
+		if errors.Is(err, errHoldNotExpired) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// StartHoldExpirer expires holds once at start and then every minute, until
+// ctx is done
+func StartHoldExpirer(ctx context.Context, circ *Circulation, timeout time.Duration) {
+	expire := func() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		n, err := circ.ExpireHolds(ctx)
+		if err != nil {
+			slog.Error("Failed to expire holds", "error", err)
+		}
+		if n > 0 {
+			slog.Info("Expired holds", "holds", n)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(holdExpiryInterval)
+		defer ticker.Stop()
+
+		expire()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expire()
+			}
+		}
+	}()
+}
+
+// ListHolds returns the holds matching the filter, oldest first. Waiting
+// holds of a single book carry their position in the queue.
+func (circ *Circulation) ListHolds(ctx context.Context, f HoldFilter) ([]Hold, error) {
+	filter := bson.M{}
+	if f.BookID != "" {
+		filter["book_id"] = f.BookID
+	}
+	if f.Borrower != "" {
+		filter["borrower"] = f.Borrower
+	}
+	if f.Active {
+		filter["active"] = true
+	}
+
+	cursor, err := circ.Holds.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "placed_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Hold{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	if f.BookID != "" && f.Borrower == "" {
+		position := 0
+		for i := range list {
+			if list[i].Status == HoldWaiting {
+				position++
+				list[i].Position = position
+			}
+		}
+	}
+	return list, nil
+}
+
+// ListNotifications returns the notifications of a recipient, newest first
+func (circ *Circulation) ListNotifications(ctx context.Context, recipient string) ([]Notification, error) {
+	cursor, err := circ.Notifications.Find(ctx, bson.M{"recipient": recipient},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(100))
+	if err != nil {
+		return nil, err
+	}
+	list := []Notification{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ActingBorrower returns the borrower a request acts for. Librarians may act
+// for anyone, requested or themselves; everyone else only for themselves. It
+// returns false if the caller may not act for requested or is anonymous.
+func ActingBorrower(c echo.Context, requested string) (string, bool) {
+	p := CurrentPrincipal(c)
+	if p == nil || p.Subject == AnonymousSubject {
+		return "", false
+	}
+	if requested == "" || requested == p.Subject {
+		return p.Subject, true
+	}
+	return requested, p.HasRole(RoleLibrarian)
+}
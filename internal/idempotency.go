@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyCollection holds the responses replayed to retried requests
+const IdempotencyCollection = "idempotency_keys"
+
+// Headers of idempotent requests. Responses replayed from an earlier attempt
+// carry IdempotentReplayedHeader.
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the keys clients may send
+	maxIdempotencyKeyLength = 255
+	// idempotencyLease is how long a request owns its key while it runs. A
+	// key whose request never finished, e.g. because the service stopped, can
+	// be used again after it.
+	idempotencyLease = time.Minute
+)
+
+// idempotencyRecord is the first request sent with a key and, once it is
+// done, its response
+type idempotencyRecord struct {
+	Key         string    `bson:"key"`
+	RequestHash string    `bson:"request_hash"`
+	Done        bool      `bson:"done"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+// IdempotencyStore replays the responses of requests sent with an
+// Idempotency-Key header, so clients can safely retry requests whose outcome
+// they do not know
+type IdempotencyStore struct {
+	coll    *mongo.Collection
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+// PrepareIdempotency returns the store keeping responses for ttl. Records
+// are removed by a TTL index once they expire.
+func PrepareIdempotency(ctx context.Context, db *mongo.Database, ttl, timeout time.Duration) (*IdempotencyStore, error) {
+	coll := db.Collection(IdempotencyCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IdempotencyStore{coll: coll, ttl: ttl, timeout: timeout}, nil
+}
+
+// Middleware runs the first request with a given Idempotency-Key and replays
+// its response to every retry with the same method, path, query and body. A retry
+// with a different request gets 422, one arriving while the first request
+// still runs 409. Keys are scoped to the caller, so it must run after
+// Authenticate. Failed requests (5xx) are not stored and may be retried.
+// Requests without the header are not affected.
+func (s *IdempotencyStore) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(IdempotencyKeyHeader)
+			if key == "" {
+				return next(c)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Idempotency key too long"})
+			}
+			if p := CurrentPrincipal(c); p != nil {
+				key = p.Subject + " " + key
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+			hash := requestHash(c.Request().Method, c.Request().URL.RequestURI(), body)
+
+			ctx, cancel := QueryContext(c, s.timeout)
+			defer cancel()
+
+			existing, err := s.claim(ctx, key, hash)
+			if err != nil {
+				return DBError(c, err, "Failed to check idempotency key")
+			}
+			if existing != nil {
+				switch {
+				case existing.RequestHash != hash:
+					return c.JSON(http.StatusUnprocessableEntity, map[string]string{
+						"error": "Idempotency key was already used for a different request",
+					})
+				case !existing.Done:
+					c.Response().Header().Set("Retry-After", "1")
+					return c.JSON(http.StatusConflict, map[string]string{
+						"error": "A request with this idempotency key is in progress",
+					})
+				}
+				c.Response().Header().Set(IdempotentReplayedHeader, "true")
+				return c.Blob(existing.Status, existing.ContentType, existing.Body)
+			}
+
+			// Keep a copy of the response to replay it
+			var recorded bytes.Buffer
+			res := c.Response()
+			res.Writer = &recordingWriter{ResponseWriter: res.Writer, body: &recorded}
+
+			err = next(c)
+
+			// Store the outcome even if the client went away in the meantime
+			ctx, cancel = context.WithTimeout(context.WithoutCancel(c.Request().Context()), s.timeout)
+			defer cancel()
+			if err != nil || res.Status >= http.StatusInternalServerError || res.Status == StatusClientClosedRequest {
+				s.release(ctx, c, key)
+				return err
+			}
+			_, saveErr := s.coll.UpdateOne(ctx, bson.M{"key": key}, bson.M{"$set": bson.M{
+				"done":         true,
+				"status":       res.Status,
+				"content_type": res.Header().Get(echo.HeaderContentType),
+				"body":         recorded.Bytes(),
+				"expires_at":   time.Now().UTC().Add(s.ttl),
+			}})
+			if saveErr != nil {
+				Logger(c).Error("Failed to save idempotent response", "error", saveErr)
+				s.release(ctx, c, key)
+			}
+			return nil
+		}
+	}
+}
+
+// claim reserves key for the request. If the key is taken, the record
+// holding it is returned instead. Records whose lease or TTL ran out are
+// replaced.
+func (s *IdempotencyStore) claim(ctx context.Context, key, hash string) (*idempotencyRecord, error) {
+	for attempt := 0; ; attempt++ {
+		_, err := s.coll.InsertOne(ctx, idempotencyRecord{
+			Key:         key,
+			RequestHash: hash,
+			ExpiresAt:   time.Now().UTC().Add(idempotencyLease),
+		})
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) || attempt > 0 {
+			return nil, err
+		}
+
+		var existing idempotencyRecord
+		err = s.coll.FindOne(ctx, bson.M{"key": key}).Decode(&existing)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if existing.ExpiresAt.After(time.Now()) {
+			return &existing, nil
+		}
+		// Expired, but not yet removed by the TTL index
+		_, err = s.coll.DeleteOne(ctx, bson.M{"key": key, "expires_at": existing.ExpiresAt})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// release frees the key of a failed request for retries
+func (s *IdempotencyStore) release(ctx context.Context, c echo.Context, key string) {
+	if _, err := s.coll.DeleteOne(ctx, bson.M{"key": key, "done": false}); err != nil {
+		Logger(c).Error("Failed to release idempotency key", "error", err)
+	}
+}
+
+// requestHash identifies a request by method, path with query and body
+func requestHash(method, uri string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + uri + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingWriter copies the response body while it is written
+type recordingWriter struct {
+	http.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
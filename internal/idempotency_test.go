@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const idempotentBody = `{"title":"Dune"}`
+
+// idempotencyRecordFound is the response of MongoDB to the lookup of the
+// record holding the key of an earlier request with body
+func idempotencyRecordFound(body string, done bool, expiresAt time.Time) []bson.D {
+	record := bson.D{
+		{Key: "key", Value: "alice k1"},
+		{Key: "request_hash", Value: requestHash(http.MethodPost, "/api/books", []byte(body))},
+		{Key: "done", Value: done},
+		{Key: "expires_at", Value: expiresAt},
+	}
+	if done {
+		record = append(record,
+			bson.E{Key: "status", Value: http.StatusCreated},
+			bson.E{Key: "content_type", Value: echo.MIMEApplicationJSON},
+			bson.E{Key: "body", Value: []byte(`{"id":"b1"}`)},
+		)
+	}
+	return []bson.D{
+		mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"}),
+		mtest.CreateCursorResponse(0, "test.idempotency_keys", mtest.FirstBatch, record),
+	}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	ok := mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})
+	later := time.Now().Add(time.Minute)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range []struct {
+		name string
+		// mongo are the responses to the commands of the store
+		mongo []bson.D
+		body  string
+		// status is the answer of the handler, want the one of the request
+		status  int
+		want    int
+		handled bool
+		// replayed tells whether the response comes from the record
+		replayed bool
+		commands []string
+	}{
+		{
+			name:     "first request",
+			mongo:    []bson.D{ok, ok},
+			body:     idempotentBody,
+			status:   http.StatusCreated,
+			want:     http.StatusCreated,
+			handled:  true,
+			commands: []string{"insert", "update"},
+		},
+		{
+			name:     "replay with the same body",
+			mongo:    idempotencyRecordFound(idempotentBody, true, later),
+			body:     idempotentBody,
+			want:     http.StatusCreated,
+			replayed: true,
+			commands: []string{"insert", "find"},
+		},
+		{
+			name:     "different body",
+			mongo:    idempotencyRecordFound(idempotentBody, true, later),
+			body:     `{"title":"Emma"}`,
+			want:     http.StatusUnprocessableEntity,
+			commands: []string{"insert", "find"},
+		},
+		{
+			name:     "first request in flight",
+			mongo:    idempotencyRecordFound(idempotentBody, false, later),
+			body:     idempotentBody,
+			want:     http.StatusConflict,
+			commands: []string{"insert", "find"},
+		},
+		{
+			name:     "expired record replaced",
+			mongo:    append(idempotencyRecordFound(idempotentBody, true, time.Now().Add(-time.Minute)), ok, ok, ok),
+			body:     idempotentBody,
+			status:   http.StatusCreated,
+			want:     http.StatusCreated,
+			handled:  true,
+			commands: []string{"insert", "find", "delete", "insert", "update"},
+		},
+		{
+			name:     "server error not stored",
+			mongo:    []bson.D{ok, ok},
+			body:     idempotentBody,
+			status:   http.StatusServiceUnavailable,
+			want:     http.StatusServiceUnavailable,
+			handled:  true,
+			commands: []string{"insert", "delete"},
+		},
+		{
+			name:     "client error stored",
+			mongo:    []bson.D{ok, ok},
+			body:     idempotentBody,
+			status:   http.StatusBadRequest,
+			want:     http.StatusBadRequest,
+			handled:  true,
+			commands: []string{"insert", "update"},
+		},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tc.mongo...)
+			store := &IdempotencyStore{coll: mt.Coll, ttl: time.Hour, timeout: time.Second}
+
+			handled := false
+			e := echo.New()
+			e.POST("/api/books", func(c echo.Context) error {
+				handled = true
+				return c.JSON(tc.status, map[string]string{"id": "b1"})
+			}, func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					c.Set(principalKey, &Principal{Subject: "alice", Roles: []Role{RoleLibrarian}})
+					return next(c)
+				}
+			}, store.Middleware())
+
+			req := httptest.NewRequest(http.MethodPost, "/api/books", strings.NewReader(tc.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(IdempotencyKeyHeader, "k1")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				mt.Errorf("status %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+			if handled != tc.handled {
+				mt.Errorf("handler called: %v, want %v", handled, tc.handled)
+			}
+			if replayed := rec.Header().Get(IdempotentReplayedHeader) == "true"; replayed != tc.replayed {
+				mt.Errorf("replayed: %v, want %v", replayed, tc.replayed)
+			}
+			if tc.replayed && strings.TrimSpace(rec.Body.String()) != `{"id":"b1"}` {
+				mt.Errorf("replayed body %s", rec.Body)
+			}
+			if tc.want == http.StatusConflict && rec.Header().Get("Retry-After") == "" {
+				mt.Error("409 without Retry-After")
+			}
+
+			var commands []string
+			for _, evt := range mt.GetAllStartedEvents() {
+				commands = append(commands, evt.CommandName)
+				// Keys are scoped to the caller
+				if evt.CommandName == "insert" {
+					if key := evt.Command.Lookup("documents", "0", "key").StringValue(); key != "alice k1" {
+						mt.Errorf("claimed key %q, want %q", key, "alice k1")
+					}
+				}
+			}
+			if strings.Join(commands, ",") != strings.Join(tc.commands, ",") {
+				mt.Errorf("commands %v, want %v", commands, tc.commands)
+			}
+		})
+	}
+}
+
+func TestIdempotencyMiddlewareWithoutKey(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("no key", func(mt *mtest.T) {
+		store := &IdempotencyStore{coll: mt.Coll, ttl: time.Hour, timeout: time.Second}
+		e := echo.New()
+		e.POST("/api/books", func(c echo.Context) error {
+			return c.NoContent(http.StatusCreated)
+		}, store.Middleware())
+
+		for _, key := range []string{"", strings.Repeat("k", maxIdempotencyKeyLength+1)} {
+			req := httptest.NewRequest(http.MethodPost, "/api/books", strings.NewReader(idempotentBody))
+			if key != "" {
+				req.Header.Set(IdempotencyKeyHeader, key)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			want := http.StatusCreated
+			if key != "" {
+				want = http.StatusBadRequest
+			}
+			if rec.Code != want {
+				mt.Errorf("key of %d bytes: status %d, want %d", len(key), rec.Code, want)
+			}
+		}
+		if events := mt.GetAllStartedEvents(); len(events) != 0 {
+			mt.Errorf("%d commands sent without a usable key", len(events))
+		}
+	})
+}
@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoansCollection holds the checkouts of books, open and returned ones
+const LoansCollection = "loans"
+
+var (
+	ErrNoCopyAvailable = errors.New("no copy available")
+	ErrLoanNotFound    = errors.New("loan not found")
+	ErrCopiesTaken     = errors.New("more copies on loan or on hold")
+)
+
+// Loan is a copy of a book checked out to a member. ReturnedAt is nil
+// while the loan is open. Fine is charged in cents if it was returned late.
+type Loan struct {
+	ID           string     `bson:"id" json:"id"`
+	BookID       string     `bson:"book_id" json:"book_id"`
+	Borrower     string     `bson:"borrower" json:"borrower"`
+	CheckedOutAt time.Time  `bson:"checked_out_at" json:"checked_out_at"`
+	CheckedOutBy string     `bson:"checked_out_by" json:"checked_out_by"`
+	DueAt        time.Time  `bson:"due_at" json:"due_at"`
+	ReturnedAt   *time.Time `bson:"returned_at,omitempty" json:"returned_at,omitempty"`
+	Fine         int        `bson:"fine,omitempty" json:"fine,omitempty"`
+}
+
+// Overdue reports whether the loan is open past its due date
+func (l Loan) Overdue(now time.Time) bool {
+	return l.ReturnedAt == nil && now.After(l.DueAt)
+}
+
+// LoanFilter selects loans, empty fields match every loan
+type LoanFilter struct {
+	BookID   string
+	Borrower string
+	// Open restricts the list to loans that were not returned
+	Open bool
+	// OverdueAt restricts the list to loans open past their due date at
+	// that time
+	OverdueAt time.Time
+}
+
+// CirculationPolicy holds the lending rules
+type CirculationPolicy struct {
+	// LoanPeriod is how long a book may be borrowed, HoldPeriod how long a
+	// copy is kept for the hold it is ready for
+	LoanPeriod time.Duration
+	HoldPeriod time.Duration
+	// MaxLoans is the default limit of books a member may borrow at once
+	MaxLoans int
+	// FinePerDay is charged in cents for every started day a book is late
+	FinePerDay int
+}
+
+// Circulation lends the copies of the books to the members. The copies taken
+// are counted in the on_loan and on_hold fields of each book, changed in the
+// same transaction as the loan or hold and published through the outbox.
+type Circulation struct {
+	Books         *mongo.Collection
+	Loans         *mongo.Collection
+	Holds         *mongo.Collection
+	Members       *mongo.Collection
+	Notifications *mongo.Collection
+	Outbox        *mongo.Collection
+
+	CirculationPolicy
+}
+
+// PrepareCirculation returns the circulation of the books in coll
+func PrepareCirculation(ctx context.Context, db *mongo.Database, books, outbox *mongo.Collection, policy CirculationPolicy) (*Circulation, error) {
+	loans := db.Collection(LoansCollection)
+	_, err := loans.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "book_id", Value: 1}, {Key: "borrower", Value: 1}}},
+		{Keys: bson.D{{Key: "borrower", Value: 1}, {Key: "checked_out_at", Value: -1}}},
+		{Keys: bson.D{{Key: "due_at", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	holds, notifications, err := prepareHolds(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	members, err := prepareMembers(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return &Circulation{
+		Books:             books,
+		Loans:             loans,
+		Holds:             holds,
+		Members:           members,
+		Notifications:     notifications,
+		Outbox:            outbox,
+		CirculationPolicy: policy,
+	}, nil
+}
+
+// TakenAtMost restricts a filter to the books with at most n copies on loan
+// or on hold, i.e., those that may be reduced to n copies
+func TakenAtMost(filter bson.M, n int) bson.M {
+	filter["$expr"] = bson.M{"$lte": bson.A{
+		bson.M{"$add": bson.A{
+			bson.M{"$ifNull": bson.A{"$on_loan", 0}},
+			bson.M{"$ifNull": bson.A{"$on_hold", 0}},
+		}},
+		n,
+	}}
+	return filter
+}
+
+// transaction runs fn in a transaction of the books' client
+func (circ *Circulation) transaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error {
+	return WithTransaction(ctx, circ.Books.Database().Client(), fn)
+}
+
+// Checkout lends a copy of the book to borrower for LoanPeriod. A copy kept
+// for a hold of the borrower is taken first. Otherwise on_loan is only
+// raised while copies are left, so concurrent checkouts cannot lend more
+// copies than there are. It returns mongo.ErrNoDocuments if the book does not
+// exist and ErrNoCopyAvailable if every copy is taken. The borrower must be
+// an active member without fines due below their loan limit, see
+// takeLoanSlot for the errors.
+func (circ *Circulation) Checkout(ctx context.Context, actor Actor, bookID, borrower string) (*Loan, error) {
+	id, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	loan := &Loan{
+		ID:           id,
+		BookID:       bookID,
+		Borrower:     borrower,
+		CheckedOutAt: now,
+		CheckedOutBy: actor.Subject,
+		DueAt:        now.Add(circ.LoanPeriod),
+	}
+
+	err = circ.transaction(ctx, func(ctx mongo.SessionContext) error {
+		if err := circ.takeLoanSlot(ctx, borrower); err != nil {
+			return err
+		}
+		fulfilled, err := circ.fulfilHold(ctx, bookID, borrower)
+		if err != nil {
+			return err
+		}
+
+		var filter, update bson.M
+		if fulfilled {
+			filter = NotDeleted(bson.M{"id": bookID})
+			update = bson.M{"$inc": bson.M{"on_loan": 1, "on_hold": -1}}
+		} else {
+			filter = NotDeleted(bson.M{
+				"id": bookID,
+				"$expr": bson.M{"$lt": bson.A{
+					bson.M{"$add": bson.A{
+						bson.M{"$ifNull": bson.A{"$on_loan", 0}},
+						bson.M{"$ifNull": bson.A{"$on_hold", 0}},
+					}},
+					bson.M{"$max": bson.A{bson.M{"$ifNull": bson.A{"$copies", 1}}, 1}},
+				}},
+			})
+			update = bson.M{"$inc": bson.M{"on_loan": 1}}
+		}
+		var after bson.M
+		err = circ.Books.FindOneAndUpdate(ctx, filter, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&after)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			count, err := circ.Books.CountDocuments(ctx, NotDeleted(bson.M{"id": bookID}))
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrNoCopyAvailable
+			}
+			return mongo.ErrNoDocuments
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := circ.Loans.InsertOne(ctx, loan); err != nil {
+			return err
+		}
+		return Publish(ctx, circ.Outbox, BookUpdated, bookID, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return loan, nil
+}
+
+// Return closes the oldest open loan of the book to borrower and charges the
+// fine if it is late. The copy goes to the next hold on the book, if any. It
+// returns ErrLoanNotFound if there is no open loan.
+func (circ *Circulation) Return(ctx context.Context, bookID, borrower string) (*Loan, error) {
+	var loan Loan
+	err := circ.transaction(ctx, func(ctx mongo.SessionContext) error {
+		open := bson.M{"book_id": bookID, "borrower": borrower, "returned_at": bson.M{"$exists": false}}
+		err := circ.Loans.FindOne(ctx, open,
+			options.FindOne().SetSort(bson.D{{Key: "checked_out_at", Value: 1}}),
+		).Decode(&loan)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrLoanNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		loan.ReturnedAt = &now
+		loan.Fine = circ.fine(loan, now)
+		_, err = circ.Loans.UpdateOne(ctx,
+			bson.M{"id": loan.ID},
+			bson.M{"$set": bson.M{"returned_at": now, "fine": loan.Fine}},
+		)
+		if err != nil {
+			return err
+		}
+		_, err = circ.Members.UpdateOne(ctx,
+			bson.M{"id": borrower},
+			bson.M{"$inc": bson.M{"open_loans": -1, "fines_due": loan.Fine}},
+		)
+		if err != nil {
+			return err
+		}
+		return circ.releaseCopy(ctx, bookID, "on_loan")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loan, nil
+}
+
+// releaseCopy gives back a copy counted in field, on_loan or on_hold. It is
+// kept for the next hold on the book if there is one. It has to be called in
+// a transaction.
+func (circ *Circulation) releaseCopy(ctx context.Context, bookID, field string) error {
+	var book bson.M
+	err := circ.Books.FindOne(ctx, bson.M{"id": bookID, field: bson.M{"$gt": 0}}).Decode(&book)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Copies of deleted books are not passed on, their holds wait for a
+	// restore
+	_, deleted := book["deleted_at"]
+	inc := bson.M{field: -1}
+	if !deleted {
+		promoted, err := circ.promoteHold(ctx, bookID)
+		if err != nil {
+			return err
+		}
+		if promoted {
+			inc["on_hold"] = 1
+			if field == "on_hold" {
+				inc = bson.M{}
+			}
+		}
+	}
+	if len(inc) == 0 {
+		return nil
+	}
+
+	var after bson.M
+	err = circ.Books.FindOneAndUpdate(ctx, bson.M{"id": bookID}, bson.M{"$inc": inc},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&after)
+	if err != nil || deleted {
+		return err
+	}
+	return Publish(ctx, circ.Outbox, BookUpdated, bookID, after)
+}
+
+// ListLoans returns the loans matching the filter, most recent first
+func (circ *Circulation) ListLoans(ctx context.Context, f LoanFilter) ([]Loan, error) {
+	filter := bson.M{}
+	if f.BookID != "" {
+		filter["book_id"] = f.BookID
+	}
+	if f.Borrower != "" {
+		filter["borrower"] = f.Borrower
+	}
+	if f.Open || !f.OverdueAt.IsZero() {
+		filter["returned_at"] = bson.M{"$exists": false}
+	}
+	if !f.OverdueAt.IsZero() {
+		filter["due_at"] = bson.M{"$lt": f.OverdueAt}
+	}
+
+	cursor, err := circ.Loans.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "checked_out_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Loan{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
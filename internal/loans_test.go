@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestCheckoutDueDate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range []struct {
+		name   string
+		period time.Duration
+	}{
+		{"two weeks", 14 * 24 * time.Hour},
+		{"one day", 24 * time.Hour},
+		{"one hour", time.Hour},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			book := bson.D{{Key: "id", Value: "b1"}, {Key: "copies", Value: 1}, {Key: "on_loan", Value: 1}}
+			mt.AddMockResponses(
+				updated(1), // loan slot taken
+				updated(0), // no hold to fulfil
+				mtest.CreateSuccessResponse(bson.E{Key: "value", Value: book}),
+				mtest.CreateSuccessResponse(), // loan
+				mtest.CreateSuccessResponse(), // outbox entry
+				mtest.CreateSuccessResponse(), // commit
+			)
+			circ := testCirculation(mt)
+			circ.LoanPeriod = tc.period
+
+			before := time.Now().UTC()
+			loan, err := circ.Checkout(context.Background(), Actor{Subject: "librarian"}, "b1", "m1")
+			if err != nil {
+				mt.Fatal(err)
+			}
+
+			if due := loan.CheckedOutAt.Add(tc.period); !loan.DueAt.Equal(due) {
+				mt.Errorf("due at %s, want %s", loan.DueAt, due)
+			}
+			if loan.CheckedOutAt.Before(before) || loan.CheckedOutAt.After(time.Now()) {
+				mt.Errorf("checked out at %s, not now", loan.CheckedOutAt)
+			}
+
+			// The stored loan has the same due date, to the millisecond
+			for _, evt := range mt.GetAllStartedEvents() {
+				if evt.CommandName != "insert" {
+					continue
+				}
+				due := evt.Command.Lookup("documents", "0", "due_at")
+				if due.IsZero() {
+					continue // outbox entry
+				}
+				if stored := due.Time(); !stored.Equal(loan.DueAt.Truncate(time.Millisecond)) {
+					mt.Errorf("stored due at %s, want %s", stored, loan.DueAt)
+				}
+				return
+			}
+			mt.Error("loan not stored")
+		})
+	}
+}
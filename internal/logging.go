@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// loggerKey stores the request scoped logger in the echo context
+const loggerKey = "logger"
+
+// RequestIDAttribute is the span attribute holding the request ID
+const RequestIDAttribute = "request.id"
+
+// NewLogger creates the JSON logger of a service and installs it as the
+// default logger, so code without access to a request (e.g., PrepareData)
+// logs in the same format
+func NewLogger(service string, level slog.Level) *slog.Logger {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})).
+		With("service", service)
+	slog.SetDefault(logger)
+	return logger
+}
+
+// Logger returns the logger of the current request, tagged with its request
+// ID, or the default logger outside of the request middleware
+func Logger(c echo.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Fatal logs err and stops the service, the slog counterpart of log.Fatal
+func Fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// requestID reuses the X-Request-ID set by nginx (or the client) and
+// generates one otherwise. The ID is echoed in the response and attached to
+// the request logger, together with the trace ID of the request span, and to
+// the request span.
+func requestID(logger *slog.Logger) echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			l := logger.With("request_id", id)
+			// Logs and traces of a request can be found by either ID
+			if span := trace.SpanFromContext(c.Request().Context()); span.SpanContext().IsValid() {
+				span.SetAttributes(attribute.String(RequestIDAttribute, id))
+				l = l.With("trace_id", span.SpanContext().TraceID().String())
+			}
+			c.Set(loggerKey, l)
+		},
+	})
+}
+
+// accessLog writes one line per request once the response is known
+func accessLog() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		HandleError:  true,
+		LogMethod:    true,
+		LogURI:       true,
+		LogRoutePath: true,
+		LogStatus:    true,
+		LogLatency:   true,
+		LogRemoteIP:  true,
+		LogError:     true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attrs := []slog.Attr{
+				slog.String("method", v.Method),
+				slog.String("uri", v.URI),
+				slog.String("route", v.RoutePath),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("remote_ip", v.RemoteIP),
+			}
+			if id := c.Param("id"); id != "" {
+				attrs = append(attrs, slog.String(idKey(v.RoutePath), id))
+			}
+
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("error", v.Error.Error()))
+			}
+
+			level := slog.LevelInfo
+			if v.Status >= 500 {
+				level = slog.LevelError
+			}
+			Logger(c).LogAttrs(c.Request().Context(), level, "request", attrs...)
+			return nil
+		},
+	})
+}
+
+// idKey names the :id parameter of a route after the collection in front of
+// it, e.g., book_id for /api/books/:id and hold_id for /api/holds/:id
+func idKey(route string) string {
+	before, _, found := strings.Cut(route, "/:id")
+	if !found {
+		return "id"
+	}
+	name := before[strings.LastIndex(before, "/")+1:]
+	if name == "" {
+		return "id"
+	}
+	return strings.TrimSuffix(name, "s") + "_id"
+}
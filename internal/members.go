@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MembersCollection holds the library members, who borrow books and place
+// holds. Callers act as the member whose ID is their principal's subject:
+// the username for accounts and "apikey:<id>" for API keys. See
+// docs/members.md.
+const MembersCollection = "members"
+
+// Membership states
+const (
+	MemberActive    = "active"
+	MemberSuspended = "suspended"
+)
+
+var (
+	ErrMemberNotFound = errors.New("member not found")
+	ErrMemberExists   = errors.New("member already exists")
+	ErrInvalidMember  = errors.New("invalid member")
+	ErrMemberInactive = errors.New("membership suspended or expired")
+	ErrLoanLimit      = errors.New("loan limit reached")
+	ErrFinesDue       = errors.New("fines due")
+	ErrMemberHasLoans = errors.New("member has open loans")
+	ErrInvalidPayment = errors.New("invalid payment")
+)
+
+// Member is a borrower. OpenLoans counts the books they have checked out,
+// FinesDue the unpaid fines in cents; both only change with loans and
+// payments. MaxLoans overrides the default loan limit if set.
+type Member struct {
+	ID        string     `bson:"id" json:"id"`
+	Name      string     `bson:"name" json:"name"`
+	Email     string     `bson:"email,omitempty" json:"email,omitempty"`
+	Status    string     `bson:"status" json:"status"`
+	ExpiresAt *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	MaxLoans  int        `bson:"max_loans,omitempty" json:"max_loans,omitempty"`
+	OpenLoans int        `bson:"open_loans" json:"open_loans"`
+	FinesDue  int        `bson:"fines_due" json:"fines_due"`
+	CreatedAt time.Time  `bson:"created_at" json:"created_at"`
+}
+
+// MemberUpdate holds the fields of a member to change, nil fields are kept
+type MemberUpdate struct {
+	Name      *string    `json:"name"`
+	Email     *string    `json:"email"`
+	Status    *string    `json:"status"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	MaxLoans  *int       `json:"max_loans"`
+}
+
+// Expired reports whether the membership ran out at now
+func (m Member) Expired(now time.Time) bool {
+	return m.ExpiresAt != nil && now.After(*m.ExpiresAt)
+}
+
+func prepareMembers(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(MembersCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "name", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// validateMember checks the fields a client may set
+func validateMember(m *Member) error {
+	switch {
+	case m.ID == "" || m.Name == "":
+		return fmt.Errorf("%w: id and name are mandatory", ErrInvalidMember)
+	case m.Status != MemberActive && m.Status != MemberSuspended:
+		return fmt.Errorf("%w: status must be %s or %s", ErrInvalidMember, MemberActive, MemberSuspended)
+	case m.MaxLoans < 0:
+		return fmt.Errorf("%w: max_loans must not be negative", ErrInvalidMember)
+	}
+	return nil
+}
+
+// CreateMember adds a member, active unless a status is given. It returns
+// ErrMemberExists if the ID is taken.
+func CreateMember(ctx context.Context, coll *mongo.Collection, m Member) (*Member, error) {
+	if m.Status == "" {
+		m.Status = MemberActive
+	}
+	if err := validateMember(&m); err != nil {
+		return nil, err
+	}
+	m.OpenLoans, m.FinesDue = 0, 0
+	m.CreatedAt = time.Now().UTC()
+
+	if _, err := coll.InsertOne(ctx, m); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrMemberExists
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// FindMember returns the member with the given ID or ErrMemberNotFound
+func FindMember(ctx context.Context, coll *mongo.Collection, id string) (*Member, error) {
+	var m Member
+	err := coll.FindOne(ctx, bson.M{"id": id}).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMemberNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ListMembers returns the members sorted by name, only those with the given
+// status if it is set
+func ListMembers(ctx context.Context, coll *mongo.Collection, status string) ([]Member, error) {
+	filter := bson.M{}
+	if status != "" {
+		filter["status"] = status
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Member{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// UpdateMember changes the given fields and returns the updated member
+func UpdateMember(ctx context.Context, coll *mongo.Collection, id string, u MemberUpdate) (*Member, error) {
+	set := bson.M{}
+	if u.Name != nil {
+		set["name"] = *u.Name
+	}
+	if u.Email != nil {
+		set["email"] = *u.Email
+	}
+	if u.Status != nil {
+		set["status"] = *u.Status
+	}
+	if u.ExpiresAt != nil {
+		set["expires_at"] = u.ExpiresAt.UTC()
+	}
+	if u.MaxLoans != nil {
+		set["max_loans"] = *u.MaxLoans
+	}
+	if len(set) == 0 {
+		return FindMember(ctx, coll, id)
+	}
+
+	existing, err := FindMember(ctx, coll, id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Name != nil {
+		existing.Name = *u.Name
+	}
+	if u.Status != nil {
+		existing.Status = *u.Status
+	}
+	if u.MaxLoans != nil {
+		existing.MaxLoans = *u.MaxLoans
+	}
+	if err := validateMember(existing); err != nil {
+		return nil, err
+	}
+
+	var m Member
+	err = coll.FindOneAndUpdate(ctx, bson.M{"id": id}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMemberNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// PayFines books a payment of amount cents against the fines of a member.
+// It returns ErrInvalidPayment if amount is not positive or exceeds the
+// fines due.
+func PayFines(ctx context.Context, coll *mongo.Collection, id string, amount int) (*Member, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: amount must be positive", ErrInvalidPayment)
+	}
+	var m Member
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"id": id, "fines_due": bson.M{"$gte": amount}},
+		bson.M{"$inc": bson.M{"fines_due": -amount}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&m)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := FindMember(ctx, coll, id); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: amount exceeds the fines due", ErrInvalidPayment)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// DeleteMember removes a member without open loans and cancels their holds
+// in one transaction. It returns ErrMemberHasLoans if books are still checked
+// out to them.
+func (circ *Circulation) DeleteMember(ctx context.Context, id string) error {
+	return circ.transaction(ctx, func(ctx mongo.SessionContext) error {
+		result, err := circ.Members.DeleteOne(ctx, bson.M{"id": id, "open_loans": bson.M{"$lte": 0}})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			if _, err := FindMember(ctx, circ.Members, id); err != nil {
+				return err
+			}
+			return ErrMemberHasLoans
+		}
+
+		holds, err := circ.ListHolds(ctx, HoldFilter{Borrower: id, Active: true})
+		if err != nil {
+			return err
+		}
+		for _, hold := range holds {
+			filter := bson.M{"id": hold.ID, "active": true}
+			if _, err := circ.endHold(ctx, filter, HoldCancelled, ErrHoldNotFound); err != nil && !errors.Is(err, ErrHoldNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkMember returns ErrMemberNotFound or ErrMemberInactive unless
+// borrower is an active member
+func (circ *Circulation) checkMember(ctx context.Context, borrower string) (*Member, error) {
+	m, err := FindMember(ctx, circ.Members, borrower)
+	if err != nil {
+		return nil, err
+	}
+	if m.Status != MemberActive || m.Expired(time.Now()) {
+		return nil, ErrMemberInactive
+	}
+	return m, nil
+}
+
+// takeLoanSlot counts a new loan of borrower. It is only counted while the
+// membership is active, no fines are due and the loan limit is not reached,
+// so concurrent checkouts cannot exceed the limit. It has to be called in a
+// transaction.
+func (circ *Circulation) takeLoanSlot(ctx context.Context, borrower string) error {
+	now := time.Now().UTC()
+	result, err := circ.Members.UpdateOne(ctx, bson.M{
+		"id":        borrower,
+		"status":    MemberActive,
+		"fines_due": bson.M{"$lte": 0},
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": now}},
+		},
+		"$expr": bson.M{"$lt": bson.A{"$open_loans", bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$max_loans", 0}}, 0}},
+			"$max_loans",
+			circ.MaxLoans,
+		}}}},
+	}, bson.M{"$inc": bson.M{"open_loans": 1}})
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount > 0 {
+		return nil
+	}
+
+	// Find out which rule refused the loan
+	m, err := circ.checkMember(ctx, borrower)
+	if err != nil {
+		return err
+	}
+	if m.FinesDue > 0 {
+		return ErrFinesDue
+	}
+	return ErrLoanLimit
+}
+
+// fine is the charge for a loan returned at now, per started day late
+func (circ *Circulation) fine(loan Loan, now time.Time) int {
+	late := now.Sub(loan.DueAt)
+	if late <= 0 {
+		return 0
+	}
+	days := int((late + 24*time.Hour - 1) / (24 * time.Hour))
+	return days * circ.FinePerDay
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// testCirculation lends from the mocked collection of mt with a limit of 3
+// loans, a loan period of 14 days and a fine of 50 cents per day
+func testCirculation(mt *mtest.T) *Circulation {
+	return &Circulation{
+		Books:   mt.Coll,
+		Loans:   mt.Coll,
+		Holds:   mt.Coll,
+		Members: mt.Coll,
+		Outbox:  mt.Coll,
+		CirculationPolicy: CirculationPolicy{
+			LoanPeriod: 14 * 24 * time.Hour,
+			HoldPeriod: 3 * 24 * time.Hour,
+			MaxLoans:   3,
+			FinePerDay: 50,
+		},
+	}
+}
+
+// updated is the response of MongoDB to an update changing n documents
+func updated(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: n}, bson.E{Key: "nModified", Value: n})
+}
+
+// memberFound is the response of MongoDB to the lookup of a member, none if
+// fields is nil
+func memberFound(fields bson.D) bson.D {
+	if fields == nil {
+		return mtest.CreateCursorResponse(0, "test.members", mtest.FirstBatch)
+	}
+	return mtest.CreateCursorResponse(0, "test.members", mtest.FirstBatch, append(bson.D{{Key: "id", Value: "m1"}}, fields...))
+}
+
+func TestCirculationFine(t *testing.T) {
+	due := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		name       string
+		returned   time.Duration // after the due date
+		finePerDay int
+		want       int
+	}{
+		{"returned early", -day, 50, 0},
+		{"returned when due", 0, 50, 0},
+		{"a second late", time.Second, 50, 50},
+		{"an hour late", time.Hour, 50, 50},
+		{"a full day late", day, 50, 50},
+		{"second day started", day + time.Second, 50, 100},
+		{"a week late", 7 * day, 50, 350},
+		{"a week and an hour late", 7*day + time.Hour, 50, 400},
+		{"no fines charged", 30 * day, 0, 0},
+	} {
+		circ := &Circulation{CirculationPolicy: CirculationPolicy{FinePerDay: tc.finePerDay}}
+		if got := circ.fine(Loan{DueAt: due}, due.Add(tc.returned)); got != tc.want {
+			t.Errorf("%s: fine %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTakeLoanSlot(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range []struct {
+		name string
+		// taken tells whether the update counted the loan. Otherwise the
+		// member is looked up, nil if they do not exist.
+		taken  bool
+		member bson.D
+		want   error
+	}{
+		{name: "below the limit", taken: true},
+		{
+			name:   "loan limit reached",
+			member: bson.D{{Key: "status", Value: MemberActive}, {Key: "open_loans", Value: 3}},
+			want:   ErrLoanLimit,
+		},
+		{
+			name:   "own loan limit reached",
+			member: bson.D{{Key: "status", Value: MemberActive}, {Key: "open_loans", Value: 1}, {Key: "max_loans", Value: 1}},
+			want:   ErrLoanLimit,
+		},
+		{
+			name:   "fines due",
+			member: bson.D{{Key: "status", Value: MemberActive}, {Key: "open_loans", Value: 0}, {Key: "fines_due", Value: 150}},
+			want:   ErrFinesDue,
+		},
+		{
+			name:   "fines due at the loan limit",
+			member: bson.D{{Key: "status", Value: MemberActive}, {Key: "open_loans", Value: 3}, {Key: "fines_due", Value: 150}},
+			want:   ErrFinesDue,
+		},
+		{
+			name:   "suspended",
+			member: bson.D{{Key: "status", Value: MemberSuspended}, {Key: "fines_due", Value: 150}},
+			want:   ErrMemberInactive,
+		},
+		{
+			name:   "membership expired",
+			member: bson.D{{Key: "status", Value: MemberActive}, {Key: "expires_at", Value: expired}},
+			want:   ErrMemberInactive,
+		},
+		{name: "unknown member", member: nil, want: ErrMemberNotFound},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			if tc.taken {
+				mt.AddMockResponses(updated(1))
+			} else {
+				mt.AddMockResponses(updated(0), memberFound(tc.member))
+			}
+
+			err := testCirculation(mt).takeLoanSlot(context.Background(), "m1")
+			if !errors.Is(err, tc.want) {
+				mt.Errorf("error %v, want %v", err, tc.want)
+			}
+
+			// The default limit applies to members without their own
+			update := mt.GetAllStartedEvents()[0].Command
+			limit := update.Lookup("updates", "0", "q", "$expr", "$lt", "1", "$cond", "2")
+			if n, ok := limit.AsInt64OK(); !ok || n != 3 {
+				mt.Errorf("default loan limit %s, want 3", limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+)
+
+// MetricsPath is the route every service exposes its Prometheus metrics on
+const MetricsPath = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests handled, by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by method, route and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_operation_duration_seconds",
+		Help:    "Latency of MongoDB commands, by command name.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	mongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_operation_errors_total",
+		Help: "Number of failed MongoDB commands, by command name.",
+	}, []string{"operation"})
+)
+
+// metrics counts requests and observes their latency. Errors are handed to
+// the error handler first so the recorded status is the one sent back.
+func metrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == MetricsPath {
+				return next(c)
+			}
+
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			labels := prometheus.Labels{
+				"method": c.Request().Method,
+				"route":  route,
+				"status": strconv.Itoa(c.Response().Status),
+			}
+			httpRequests.With(labels).Inc()
+			httpDuration.With(labels).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+// MongoMonitor observes the latency and failures of every command sent
+// through the client it is installed on, and wraps each of them in a trace
+// span that is a child of the request span carried by the query context
+func MongoMonitor() *event.CommandMonitor {
+	tracing := otelmongo.NewMonitor()
+	return &event.CommandMonitor{
+		Started: tracing.Started,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			tracing.Succeeded(ctx, e)
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			tracing.Failed(ctx, e)
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			mongoErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
+
+// RegisterCatalogSize exposes the number of books in the collection, without
+// the deleted ones. The collection is counted on every scrape.
+func RegisterCatalogSize(coll *mongo.Collection, timeout time.Duration) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "catalog_books",
+		Help: "Number of books in the catalog.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		count, err := coll.CountDocuments(ctx, NotDeleted(bson.M{}))
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
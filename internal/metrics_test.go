@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// scrape returns the metrics the server exposes
+func scrape(t *testing.T, e *echo.Echo) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scraping %s: status %d", MetricsPath, rec.Code)
+	}
+	return rec.Body.String()
+}
+
+// sample returns the value of a series in a scrape
+func sample(scrape, series string) (float64, bool) {
+	for _, line := range strings.Split(scrape, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+func TestMetricsScrape(t *testing.T) {
+	e := NewServer("metrics-test", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	e.GET("/metrics-test/books/:id", func(c echo.Context) error {
+		if c.Param("id") == "missing" {
+			return echo.NewHTTPError(http.StatusNotFound, "Book not found")
+		}
+		return c.String(http.StatusOK, c.Param("id"))
+	})
+
+	// The metrics are global, so only the increase is checked
+	before := scrape(t, e)
+	for _, id := range []string{"b1", "b2", "missing"} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics-test/books/"+id, nil))
+	}
+	body := scrape(t, e)
+
+	// Requests are labelled with the route, not the path, and with the
+	// status sent back, also when the handler returned an error
+	for _, tc := range []struct {
+		series string
+		want   float64
+	}{
+		{`http_requests_total{method="GET",route="/metrics-test/books/:id",status="200"}`, 2},
+		{`http_requests_total{method="GET",route="/metrics-test/books/:id",status="404"}`, 1},
+		{`http_request_duration_seconds_count{method="GET",route="/metrics-test/books/:id",status="200"}`, 2},
+		{`http_request_duration_seconds_count{method="GET",route="/metrics-test/books/:id",status="404"}`, 1},
+		{`http_request_duration_seconds_bucket{method="GET",route="/metrics-test/books/:id",status="200",le="+Inf"}`, 2},
+	} {
+		got, ok := sample(body, tc.series)
+		if !ok {
+			t.Errorf("scrape is missing %s", tc.series)
+			continue
+		}
+		was, _ := sample(before, tc.series)
+		if got-was != tc.want {
+			t.Errorf("%s increased by %v, want %v", tc.series, got-was, tc.want)
+		}
+	}
+
+	// Scrapes are not counted, and neither are paths for every book
+	if strings.Contains(body, `route="`+MetricsPath+`"`) {
+		t.Errorf("scrapes of %s are counted", MetricsPath)
+	}
+	if strings.Contains(body, "/metrics-test/books/b1") {
+		t.Error("request path used as a label")
+	}
+}
@@ -3,8 +3,7 @@ package internal
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"slices"
 	"time"
 
@@ -23,6 +22,29 @@ type BookStore struct {
 	BookEdition string             `json:"edition,omitempty"`
 	BookPages   string             `json:"pages,omitempty"`
 	BookYear    string             `json:"year,omitempty"`
+	// Copies is the number of copies the library owns, 1 if unset. OnLoan
+	// counts the copies checked out and OnHold the ones kept for a hold,
+	// only loans and holds change them.
+	Copies int `bson:"copies,omitempty" json:"copies,omitempty"`
+	OnLoan int `bson:"on_loan,omitempty" json:"on_loan,omitempty"`
+	OnHold int `bson:"on_hold,omitempty" json:"on_hold,omitempty"`
+	// Rating is the average of the approved reviews, ReviewCount their
+	// number; only moderating reviews changes them
+	Rating      float64 `bson:"rating,omitempty" json:"rating,omitempty"`
+	ReviewCount int     `bson:"review_count,omitempty" json:"review_count,omitempty"`
+}
+
+// TotalCopies is the number of copies of the book
+func (b BookStore) TotalCopies() int {
+	if b.Copies <= 0 {
+		return 1
+	}
+	return b.Copies
+}
+
+// Available is the number of copies that can be checked out
+func (b BookStore) Available() int {
+	return max(b.TotalCopies()-b.OnLoan-b.OnHold, 0)
 }
 
 func PrepareDatabase(client *mongo.Client, dbName, collecName string) (*mongo.Collection, error) {
@@ -33,10 +55,9 @@ func PrepareDatabase(client *mongo.Client, dbName, collecName string) (*mongo.Co
 		return nil, err
 	}
 	if !slices.Contains(names, collecName) {
-		cmd := bson.D{{"create", collecName}}
+		cmd := bson.D{{Key: "create", Value: collecName}}
 		var result bson.M
 		if err = db.RunCommand(context.TODO(), cmd).Decode(&result); err != nil {
-			log.Fatal(err)
 			return nil, err
 		}
 	}
@@ -45,7 +66,7 @@ func PrepareDatabase(client *mongo.Client, dbName, collecName string) (*mongo.Co
 	return coll, nil
 }
 
-func PrepareData(client *mongo.Client, coll *mongo.Collection) {
+func PrepareData(client *mongo.Client, coll *mongo.Collection) error {
 	startData := []BookStore{
 		{ID: "example1", BookName: "The Vortex", BookAuthor: "José Eustasio Rivera", BookEdition: "958-30-0804-4", BookPages: "292", BookYear: "1924"},
 		{ID: "example2", BookName: "Frankenstein", BookAuthor: "Mary Shelley", BookEdition: "978-3-649-64609-9", BookPages: "280", BookYear: "1818"},
@@ -54,33 +75,35 @@ func PrepareData(client *mongo.Client, coll *mongo.Collection) {
 
 	for _, book := range startData {
 		cursor, err := coll.Find(context.TODO(), book)
+		if err != nil {
+			return err
+		}
 		var results []BookStore
 		if err = cursor.All(context.TODO(), &results); err != nil {
-			panic(err)
+			return err
 		}
 		if len(results) > 1 {
-			log.Fatal("more records were found")
+			return fmt.Errorf("more records were found for %q", book.ID)
 		} else if len(results) == 0 {
 			result, err := coll.InsertOne(context.TODO(), book)
 			if err != nil {
-				panic(err)
-			} else {
-				fmt.Printf("%+v\n", result)
+				return err
 			}
+			slog.Info("Inserted example book", "book_id", book.ID, "mongo_id", result.InsertedID)
 		}
 	}
+	return nil
 }
 
 // Helper to connect to MongoDB
-func ConnectDB() (*mongo.Client, context.Context, context.CancelFunc, error) {
+func ConnectDB(uri string) (*mongo.Client, context.Context, context.CancelFunc, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	uri := os.Getenv("DATABASE_URI")
 	if uri == "" {
 		cancel()
 		return nil, nil, nil, fmt.Errorf("DATABASE_URI not set")
 	}
-	opts := options.Client().ApplyURI(uri).SetServerAPIOptions(serverAPI)
+	opts := options.Client().ApplyURI(uri).SetServerAPIOptions(serverAPI).SetMonitor(MongoMonitor())
 
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
@@ -90,34 +113,55 @@ func ConnectDB() (*mongo.Client, context.Context, context.CancelFunc, error) {
 	return client, ctx, cancel, nil
 }
 
-func FindAllBooks(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
+// findBooks loads every book that is not in the trash
+func findBooks(ctx context.Context, coll *mongo.Collection) ([]BookStore, error) {
+	cursor, err := coll.Find(ctx, NotDeleted(bson.M{}))
+	if err != nil {
+		return nil, err
+	}
 	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func FindAllBooks(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	results, err := findBooks(ctx, coll)
+	if err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
 
 	for _, res := range results {
-		ret = append(ret, map[string]interface{}{
-			"id":      res.ID,          // Changed "ID" to "id" and using res.ID
-			"title":   res.BookName,    // Changed "BookName" to "title"
-			"author":  res.BookAuthor,  // Changed "BookAuthor" to "author"
-			"pages":   res.BookPages,   // Changed "BookPages" to "pages"
-			"edition": res.BookEdition, // Changed "BookEdition" to "edition"
-			"year":    res.BookYear,    // Added "year"
-		})
+		ret = append(ret, BookFields(res))
 	}
 
-	return ret
+	return ret, nil
 }
 
-func FindAllAuthors(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
-	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+// BookFields converts a book to the map returned by the API and rendered in
+// the book table
+func BookFields(res BookStore) map[string]interface{} {
+	return map[string]interface{}{
+		"id":        res.ID,          // Changed "ID" to "id" and using res.ID
+		"title":     res.BookName,    // Changed "BookName" to "title"
+		"author":    res.BookAuthor,  // Changed "BookAuthor" to "author"
+		"pages":     res.BookPages,   // Changed "BookPages" to "pages"
+		"edition":   res.BookEdition, // Changed "BookEdition" to "edition"
+		"year":      res.BookYear,    // Added "year"
+		"copies":    res.TotalCopies(),
+		"available": res.Available(),
+		"rating":    res.Rating,
+		"reviews":   res.ReviewCount,
+	}
+}
+
+func FindAllAuthors(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	results, err := findBooks(ctx, coll)
+	if err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
@@ -128,14 +172,13 @@ func FindAllAuthors(coll *mongo.Collection) []map[string]interface{} {
 		})
 	}
 
-	return ret
+	return ret, nil
 }
 
-func FindAllYears(coll *mongo.Collection) []map[string]interface{} {
-	cursor, err := coll.Find(context.TODO(), bson.D{{}})
-	var results []BookStore
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		panic(err)
+func FindAllYears(ctx context.Context, coll *mongo.Collection) ([]map[string]interface{}, error) {
+	results, err := findBooks(ctx, coll)
+	if err != nil {
+		return nil, err
 	}
 
 	var ret []map[string]interface{}
@@ -146,5 +189,5 @@ func FindAllYears(coll *mongo.Collection) []map[string]interface{} {
 		})
 	}
 
-	return ret
+	return ret, nil
 }
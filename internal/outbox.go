@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// OutboxCollection holds the events of the write services until the
+// relay-service has published them
+const OutboxCollection = "outbox"
+
+const (
+	// outboxRetention is how long published entries are kept
+	outboxRetention = 7 * 24 * time.Hour
+	// outboxLease is how long the relay owns an entry it is publishing
+	outboxLease = time.Minute
+	// outboxPollInterval is how often the outbox is checked when it is empty
+	outboxPollInterval = time.Second
+	// maxOutboxAttempts is how often an entry is handed over before it is
+	// parked. Failed entries are retried after a second, doubling up to five
+	// minutes.
+	maxOutboxAttempts = 10
+	outboxBackoff     = time.Second
+	maxOutboxBackoff  = 5 * time.Minute
+)
+
+// OutboxEntry is an event waiting to be published. Its ID is the ID of the
+// event, which consumers use to recognise events they have already seen.
+// Attempts counts the failed hand-overs, LastError is the latest failure.
+// Entries that failed maxOutboxAttempts times are parked with FailedAt and
+// stay in the outbox for inspection.
+type OutboxEntry struct {
+	ID          string     `bson:"id"`
+	Event       BookEvent  `bson:"event"`
+	CreatedAt   time.Time  `bson:"created_at"`
+	PublishedAt *time.Time `bson:"published_at,omitempty"`
+	LockedUntil time.Time  `bson:"locked_until"`
+	Attempts    int        `bson:"attempts,omitempty"`
+	LastError   string     `bson:"last_error,omitempty"`
+	FailedAt    *time.Time `bson:"failed_at,omitempty"`
+}
+
+// PrepareOutbox returns the outbox collection. Published entries expire
+// after a week.
+func PrepareOutbox(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(OutboxCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "published_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(outboxRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// WithTransaction runs fn in a MongoDB transaction, so the change of a book
+// and its outbox entry are stored together or not at all. Transactions need
+// MongoDB to run as a replica set. fn may be run again on transient errors.
+func WithTransaction(ctx context.Context, client *mongo.Client, fn func(ctx mongo.SessionContext) error) error {
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
+// Publish adds an event to the outbox. It has to be called in the
+// transaction changing the book. doc is the book after the change, nil if
+// it was deleted.
+func Publish(ctx context.Context, outbox *mongo.Collection, typ EventType, bookID string, doc bson.M) error {
+	id, err := randomString(12)
+	if err != nil {
+		return err
+	}
+	ev := BookEvent{ID: id, Type: typ, BookID: bookID, Time: time.Now().UTC()}
+	if doc != nil && typ != BookDeleted {
+		raw, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		var book BookStore
+		if err := bson.Unmarshal(raw, &book); err != nil {
+			return err
+		}
+		ev.Book = &book
+	}
+
+	_, err = outbox.InsertOne(ctx, OutboxEntry{ID: id, Event: ev, CreatedAt: ev.Time})
+	return err
+}
+
+// RunOutbox hands the outbox entries to handle, oldest first, until ctx is
+// done. An entry is marked as published once handle succeeds; if it fails,
+// or the relay stops in between, the entry is handed over again later. So
+// handle sees every event at least once and has to use the event ID to
+// ignore repeats. A failing entry is retried with backoff while later ones
+// are handed over, so it does not hold up the others.
+func RunOutbox(ctx context.Context, outbox *mongo.Collection, handle func(context.Context, BookEvent) error) {
+	for {
+		ok, err := relayNext(ctx, outbox, handle)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Failed to relay outbox entry", "error", err)
+		}
+		if ok {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// relayNext leases the oldest unpublished entry and hands it to handle. It
+// returns false when there was nothing to publish or publishing failed.
+func relayNext(ctx context.Context, outbox *mongo.Collection, handle func(context.Context, BookEvent) error) (bool, error) {
+	now := time.Now().UTC()
+	var entry OutboxEntry
+	err := outbox.FindOneAndUpdate(ctx,
+		bson.M{
+			"published_at": bson.M{"$exists": false},
+			"failed_at":    bson.M{"$exists": false},
+			"locked_until": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"locked_until": now.Add(outboxLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	).Decode(&entry)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := handle(ctx, entry.Event); err != nil {
+		// Retry the entry later, or park it once it failed too often
+		attempts := entry.Attempts + 1
+		now := time.Now().UTC()
+		update := bson.M{"attempts": attempts, "last_error": err.Error()}
+		if attempts >= maxOutboxAttempts {
+			update["failed_at"] = now
+			slog.Error("Parked outbox entry", "event_id", entry.ID, "attempts", attempts, "error", err)
+		} else {
+			update["locked_until"] = now.Add(outboxRetryBackoff(attempts))
+		}
+		_, _ = outbox.UpdateOne(ctx, bson.M{"id": entry.ID}, bson.M{"$set": update})
+		return false, err
+	}
+	_, err = outbox.UpdateOne(ctx, bson.M{"id": entry.ID}, bson.M{"$set": bson.M{"published_at": time.Now().UTC()}})
+	return true, err
+}
+
+// outboxRetryBackoff is the delay before an entry is handed over again after
+// n failed attempts
+func outboxRetryBackoff(n int) time.Duration {
+	backoff := outboxBackoff << (n - 1)
+	if backoff <= 0 || backoff > maxOutboxBackoff {
+		return maxOutboxBackoff
+	}
+	return backoff
+}
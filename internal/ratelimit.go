@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "http_requests_rate_limited_total",
+	Help: "Number of requests rejected by the rate limiter, by route.",
+}, []string{"route"})
+
+// RateLimiter is a token bucket per client kept in memory. Every client may
+// send up to limit requests at once, after which the bucket refills at limit
+// requests per minute. Each replica of a service limits on its own.
+type RateLimiter struct {
+	limit float64
+	rate  float64 // tokens per second
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitSweepInterval is how often buckets of idle clients are dropped
+const rateLimitSweepInterval = time.Minute
+
+// NewRateLimiter allows perMinute requests per client and minute. It returns
+// nil, which disables limiting, if perMinute is zero.
+func NewRateLimiter(perMinute int) *RateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	l := &RateLimiter{
+		limit:   float64(perMinute),
+		rate:    float64(perMinute) / 60,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+	go l.sweep()
+	return l
+}
+
+// take removes a token from the client's bucket. It returns whether the
+// request is allowed, the tokens left and how long until the next token.
+func (l *RateLimiter) take(key string, now time.Time) (bool, float64, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.limit, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.limit, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, b.tokens, l.duration(1 - b.tokens)
+	}
+	b.tokens--
+	return true, b.tokens, 0
+}
+
+// duration is how long the bucket takes to refill the given tokens
+func (l *RateLimiter) duration(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops the buckets that have refilled completely, they are the same
+// as a new bucket
+func (l *RateLimiter) sweep() {
+	for now := range time.Tick(rateLimitSweepInterval) {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.limit {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Middleware limits the requests of each client. Clients are told their
+// quota in the X-RateLimit-* headers and, once it is used up, are answered
+// with 429 and a Retry-After header. It must run after Authenticate:
+// authenticated callers are limited per API key or user, anonymous ones per
+// IP address. A nil limiter lets every request through.
+func (l *RateLimiter) Middleware() echo.MiddlewareFunc {
+	return l.middleware(func(c echo.Context) string {
+		if p := CurrentPrincipal(c); p != nil && p.Subject != AnonymousSubject {
+			return p.Subject
+		}
+		return "ip:" + c.RealIP()
+	})
+}
+
+// IPMiddleware limits the requests of each IP address, whoever sends them.
+// It runs before Authenticate, so a flood of invalid or revoked credentials
+// is rejected without looking each of them up. The client IP is only taken
+// from X-Forwarded-For behind a trusted proxy, see IPExtractor.
+func (l *RateLimiter) IPMiddleware() echo.MiddlewareFunc {
+	return l.middleware(func(c echo.Context) string {
+		return "ip:" + c.RealIP()
+	})
+}
+
+// middleware limits the requests of each client identified by key
+func (l *RateLimiter) middleware(key func(echo.Context) string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if l == nil {
+			return next
+		}
+		return func(c echo.Context) error {
+			key := key(c)
+			allowed, remaining, retryAfter := l.take(key, l.now())
+			h := c.Response().Header()
+			h.Set("X-RateLimit-Limit", strconv.Itoa(int(l.limit)))
+			h.Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+			// Seconds until the bucket is full again
+			h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(l.duration(l.limit-remaining).Seconds()))))
+
+			if !allowed {
+				h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				rateLimited.WithLabelValues(c.Path()).Inc()
+				Logger(c).Info("Rate limited", "client", key)
+				return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "Too many requests"})
+			}
+			return next(c)
+		}
+	}
+}
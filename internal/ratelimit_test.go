@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testSubjectHeader names the principal of a test request, standing in for
+// Authenticate
+const testSubjectHeader = "X-Test-Subject"
+
+// clock is a time the tests move forward by hand
+type clock struct{ t time.Time }
+
+func newClock() *clock {
+	return &clock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestRateLimiterTake(t *testing.T) {
+	// 3 requests per minute, i.e., a token every 20 seconds
+	l := NewRateLimiter(3)
+	clk := newClock()
+
+	for i, step := range []struct {
+		advance    time.Duration
+		allowed    bool
+		remaining  float64
+		retryAfter time.Duration
+	}{
+		// The full bucket allows a burst of 3
+		{0, true, 2, 0},
+		{0, true, 1, 0},
+		{0, true, 0, 0},
+		{0, false, 0, 20 * time.Second},
+		// Half a token refilled, the rest takes 10 seconds
+		{10 * time.Second, false, 0.5, 10 * time.Second},
+		{10 * time.Second, true, 0, 0},
+		// An idle client never has more than a full bucket
+		{time.Hour, true, 2, 0},
+	} {
+		clk.advance(step.advance)
+		allowed, remaining, retryAfter := l.take("alice", clk.now())
+		if allowed != step.allowed || math.Abs(remaining-step.remaining) > 1e-9 || retryAfter.Round(time.Millisecond) != step.retryAfter {
+			t.Errorf("step %d: take = %v, %v, %s; want %v, %v, %s",
+				i, allowed, remaining, retryAfter, step.allowed, step.remaining, step.retryAfter)
+		}
+	}
+}
+
+// limitedServer answers 200 to requests passing the middleware of l.
+// Requests are attributed to their remote address and to the subject in
+// testSubjectHeader, if any.
+func limitedServer(l *RateLimiter, middleware func(*RateLimiter) echo.MiddlewareFunc) *echo.Echo {
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	authenticate := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if subject := c.Request().Header.Get(testSubjectHeader); subject != "" {
+				c.Set(principalKey, &Principal{Subject: subject, Roles: []Role{RoleReader}})
+			}
+			return next(c)
+		}
+	}
+	e.GET("/api/books", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, authenticate, middleware(l))
+	return e
+}
+
+// limitedRequest sends a request from ip on behalf of subject
+func limitedRequest(e *echo.Echo, ip, subject string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+	req.RemoteAddr = ip + ":40000"
+	if subject != "" {
+		req.Header.Set(testSubjectHeader, subject)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	// 2 requests per minute, i.e., a token every 30 seconds
+	l := NewRateLimiter(2)
+	clk := newClock()
+	l.now = clk.now
+	e := limitedServer(l, (*RateLimiter).Middleware)
+
+	for _, step := range []struct {
+		name      string
+		advance   time.Duration
+		ip        string
+		subject   string
+		status    int
+		remaining string
+		reset     string
+		// retryAfter is only sent with 429
+		retryAfter string
+	}{
+		{"first anonymous request", 0, "192.0.2.1", "", http.StatusOK, "1", "30", ""},
+		{"second anonymous request", 0, "192.0.2.1", "", http.StatusOK, "0", "60", ""},
+		{"anonymous bucket empty", 0, "192.0.2.1", "", http.StatusTooManyRequests, "0", "60", "30"},
+		{"anonymous principal shares the IP bucket", 0, "192.0.2.1", AnonymousSubject, http.StatusTooManyRequests, "0", "60", "30"},
+		{"user from the same IP", 0, "192.0.2.1", "alice", http.StatusOK, "1", "30", ""},
+		{"another IP", 0, "192.0.2.2", "", http.StatusOK, "1", "30", ""},
+		{"same user from another IP", 0, "192.0.2.2", "alice", http.StatusOK, "0", "60", ""},
+		{"user bucket empty", 0, "192.0.2.3", "alice", http.StatusTooManyRequests, "0", "60", "30"},
+		{"refilled", 30 * time.Second, "192.0.2.1", "", http.StatusOK, "0", "60", ""},
+	} {
+		clk.advance(step.advance)
+		rec := limitedRequest(e, step.ip, step.subject)
+		h := rec.Header()
+		if rec.Code != step.status {
+			t.Errorf("%s: status %d, want %d", step.name, rec.Code, step.status)
+		}
+		if got := h.Get("X-RateLimit-Limit"); got != "2" {
+			t.Errorf("%s: X-RateLimit-Limit %q, want 2", step.name, got)
+		}
+		if got := h.Get("X-RateLimit-Remaining"); got != step.remaining {
+			t.Errorf("%s: X-RateLimit-Remaining %q, want %q", step.name, got, step.remaining)
+		}
+		if got := h.Get("X-RateLimit-Reset"); got != step.reset {
+			t.Errorf("%s: X-RateLimit-Reset %q, want %q", step.name, got, step.reset)
+		}
+		if got := h.Get("Retry-After"); got != step.retryAfter {
+			t.Errorf("%s: Retry-After %q, want %q", step.name, got, step.retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterIPMiddleware(t *testing.T) {
+	l := NewRateLimiter(2)
+	clk := newClock()
+	l.now = clk.now
+	e := limitedServer(l, (*RateLimiter).IPMiddleware)
+
+	// Every caller behind an IP address shares its bucket, whatever
+	// credentials they send
+	for i, step := range []struct {
+		ip, subject string
+		status      int
+	}{
+		{"192.0.2.1", "alice", http.StatusOK},
+		{"192.0.2.1", "bob", http.StatusOK},
+		{"192.0.2.1", "", http.StatusTooManyRequests},
+		{"192.0.2.1", "carol", http.StatusTooManyRequests},
+		{"192.0.2.2", "alice", http.StatusOK},
+	} {
+		if rec := limitedRequest(e, step.ip, step.subject); rec.Code != step.status {
+			t.Errorf("request %d from %s as %q: status %d, want %d", i+1, step.ip, step.subject, rec.Code, step.status)
+		}
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := NewRateLimiter(0)
+	if l != nil {
+		t.Fatal("limit 0 does not disable the limiter")
+	}
+	e := limitedServer(l, (*RateLimiter).Middleware)
+	for i := 0; i < 100; i++ {
+		if rec := limitedRequest(e, "192.0.2.1", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, rec.Code)
+		}
+	}
+}
+
+func TestIPExtractor(t *testing.T) {
+	extract := IPExtractor([]string{"172.28.0.10/32"})
+	for _, tc := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"forwarded by nginx", "172.28.0.10", "203.0.113.7", "203.0.113.7"},
+		{"forwarded twice", "172.28.0.10", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"nginx without header", "172.28.0.10", "", "172.28.0.10"},
+		{"private address is no proxy", "172.28.0.11", "203.0.113.7", "172.28.0.11"},
+		{"loopback is no proxy", "127.0.0.1", "203.0.113.7", "127.0.0.1"},
+		{"direct client", "198.51.100.9", "203.0.113.7", "198.51.100.9"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/books", nil)
+		req.RemoteAddr = tc.remote + ":40000"
+		if tc.forwarded != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, tc.forwarded)
+		}
+		if got := extract(req); got != tc.want {
+			t.Errorf("%s: client IP %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
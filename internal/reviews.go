@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReviewsCollection holds the reviews of the books
+const ReviewsCollection = "reviews"
+
+// Review states. New reviews are pending until a librarian approves or
+// rejects them, only approved ones are shown and rated.
+const (
+	ReviewPending  = "pending"
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// maxReviewLength bounds the text of a review, in characters
+const maxReviewLength = 5000
+
+var (
+	ErrReviewNotFound = errors.New("review not found")
+	ErrReviewExists   = errors.New("book already reviewed")
+	ErrInvalidReview  = errors.New("invalid review")
+)
+
+// Review is a rating of a book from 1 to 5 with an optional text. Every
+// reader reviews a book at most once.
+type Review struct {
+	ID          string     `bson:"id" json:"id"`
+	BookID      string     `bson:"book_id" json:"book_id"`
+	Author      string     `bson:"author" json:"author"`
+	Rating      int        `bson:"rating" json:"rating"`
+	Text        string     `bson:"text,omitempty" json:"text,omitempty"`
+	Status      string     `bson:"status" json:"status"`
+	CreatedAt   time.Time  `bson:"created_at" json:"created_at"`
+	ModeratedBy string     `bson:"moderated_by,omitempty" json:"moderated_by,omitempty"`
+	ModeratedAt *time.Time `bson:"moderated_at,omitempty" json:"moderated_at,omitempty"`
+}
+
+// ReviewFilter selects reviews, empty fields match every review
+type ReviewFilter struct {
+	BookID string
+	Status string
+}
+
+// PrepareReviews returns the reviews collection
+func PrepareReviews(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(ReviewsCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys:    bson.D{{Key: "book_id", Value: 1}, {Key: "author", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// AddReview stores the review of author, pending moderation. It returns
+// mongo.ErrNoDocuments if the book does not exist, ErrInvalidReview for
+// ratings outside 1–5 or overlong texts and ErrReviewExists if author
+// already reviewed the book.
+func AddReview(ctx context.Context, books, reviews *mongo.Collection, bookID, author string, rating int, text string) (*Review, error) {
+	if rating < 1 || rating > 5 {
+		return nil, fmt.Errorf("%w: rating must be between 1 and 5", ErrInvalidReview)
+	}
+	if utf8.RuneCountInString(text) > maxReviewLength {
+		return nil, fmt.Errorf("%w: text must not exceed %d characters", ErrInvalidReview, maxReviewLength)
+	}
+	if err := books.FindOne(ctx, NotDeleted(bson.M{"id": bookID})).Err(); err != nil {
+		return nil, err
+	}
+
+	id, err := randomString(8)
+	if err != nil {
+		return nil, err
+	}
+	review := &Review{
+		ID:        id,
+		BookID:    bookID,
+		Author:    author,
+		Rating:    rating,
+		Text:      text,
+		Status:    ReviewPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := reviews.InsertOne(ctx, review); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrReviewExists
+		}
+		return nil, err
+	}
+	return review, nil
+}
+
+// ListReviews returns the reviews matching the filter, newest first
+func ListReviews(ctx context.Context, coll *mongo.Collection, f ReviewFilter) ([]Review, error) {
+	filter := bson.M{}
+	if f.BookID != "" {
+		filter["book_id"] = f.BookID
+	}
+	if f.Status != "" {
+		filter["status"] = f.Status
+	}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	list := []Review{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ModerateReview approves or rejects a review and updates the rating of its
+// book in the same transaction. It returns ErrInvalidReview for other states
+// and ErrReviewNotFound for unknown reviews.
+func ModerateReview(ctx context.Context, books, reviews, outbox *mongo.Collection, actor Actor, id, status string) (*Review, error) {
+	if status != ReviewApproved && status != ReviewRejected {
+		return nil, fmt.Errorf("%w: status must be %s or %s", ErrInvalidReview, ReviewApproved, ReviewRejected)
+	}
+
+	var review Review
+	err := WithTransaction(ctx, books.Database().Client(), func(ctx mongo.SessionContext) error {
+		err := reviews.FindOneAndUpdate(ctx, bson.M{"id": id},
+			bson.M{"$set": bson.M{"status": status, "moderated_by": actor.Subject, "moderated_at": time.Now().UTC()}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&review)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return ErrReviewNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return updateRating(ctx, books, reviews, outbox, review.BookID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// updateRating aggregates the approved reviews of a book into its rating
+// and review_count fields, so listings show them without a lookup. It has to
+// be called in a transaction.
+func updateRating(ctx context.Context, books, reviews, outbox *mongo.Collection, bookID string) error {
+	cursor, err := reviews.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"book_id": bookID, "status": ReviewApproved}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":    nil,
+			"rating": bson.M{"$avg": "$rating"},
+			"count":  bson.M{"$sum": 1},
+		}}},
+		{{Key: "$project", Value: bson.M{"rating": bson.M{"$round": bson.A{"$rating", 1}}, "count": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	var results []struct {
+		Rating float64 `bson:"rating"`
+		Count  int     `bson:"count"`
+	}
+	if err = cursor.All(ctx, &results); err != nil {
+		return err
+	}
+
+	update := bson.M{"$unset": bson.M{"rating": "", "review_count": ""}}
+	if len(results) > 0 {
+		update = bson.M{"$set": bson.M{"rating": results[0].Rating, "review_count": results[0].Count}}
+	}
+	var after bson.M
+	err = books.FindOneAndUpdate(ctx, bson.M{"id": bookID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&after)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, deleted := after["deleted_at"]; deleted {
+		return nil
+	}
+	return Publish(ctx, outbox, BookUpdated, bookID, after)
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RevisionsCollection keeps the previous versions of every book
+const RevisionsCollection = "revisions"
+
+// AuditRevert is the audit action of restoring a revision
+const AuditRevert = "revert"
+
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// Revision is a version of a book as it was before it was changed. Revisions
+// are numbered from 1 per book.
+type Revision struct {
+	BookID    string    `bson:"book_id" json:"book_id"`
+	Rev       int       `bson:"rev" json:"rev"`
+	Time      time.Time `bson:"time" json:"time"`
+	Actor     string    `bson:"actor" json:"actor"`
+	RequestID string    `bson:"request_id" json:"request_id"`
+	// Document is the stored book before the change
+	Document bson.M `bson:"document" json:"document"`
+	// Changes is the change that replaced this version
+	Changes map[string]AuditChange `bson:"changes" json:"changes"`
+}
+
+// PrepareRevisions returns the revisions collection. Revision numbers are
+// unique per book.
+func PrepareRevisions(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(RevisionsCollection)
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "book_id", Value: 1}, {Key: "rev", Value: -1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// SaveRevision stores before as the next revision of the book. Like the
+// audit log, it has to be written in the transaction changing the book:
+// concurrent changes of the book conflict there and are retried as a whole,
+// so they cannot take the same revision number.
+func SaveRevision(ctx context.Context, coll *mongo.Collection, actor Actor, bookID string, before, after bson.M) error {
+	// The revision carries the same metadata as the audit entry of the change
+	entry := NewAuditEntry(actor, AuditUpdate, bookID, before, after)
+	document := bson.M{}
+	for field, value := range before {
+		if field != "_id" {
+			document[field] = value
+		}
+	}
+
+	var last Revision
+	err := coll.FindOne(ctx, bson.M{"book_id": bookID},
+		options.FindOne().SetSort(bson.D{{Key: "rev", Value: -1}}),
+	).Decode(&last)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+
+	_, err = coll.InsertOne(ctx, Revision{
+		BookID:    bookID,
+		Rev:       last.Rev + 1,
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		RequestID: entry.RequestID,
+		Document:  document,
+		Changes:   entry.Changes,
+	})
+	return err
+}
+
+// ListRevisions returns the revisions of a book, newest first
+func ListRevisions(ctx context.Context, coll *mongo.Collection, bookID string) ([]Revision, error) {
+	cursor, err := coll.Find(ctx, bson.M{"book_id": bookID},
+		options.Find().SetSort(bson.D{{Key: "rev", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	revisions := []Revision{}
+	if err = cursor.All(ctx, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// RevertBook replaces the book with one of its revisions. The replaced
+// version becomes a new revision, so a revert can be reverted as well.
+// It returns mongo.ErrNoDocuments if the book does not exist and
+// ErrRevisionNotFound for unknown revisions.
+func RevertBook(ctx context.Context, books, revisions, audit, outbox *mongo.Collection, actor Actor, bookID string, rev int) error {
+	var revision Revision
+	err := revisions.FindOne(ctx, bson.M{"book_id": bookID, "rev": rev}).Decode(&revision)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrRevisionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	restored := revision.Document
+	delete(restored, "_id")
+	restored["id"] = bookID
+
+	return WithTransaction(ctx, books.Database().Client(), func(ctx mongo.SessionContext) error {
+		var before bson.M
+		if err := books.FindOne(ctx, NotDeleted(bson.M{"id": bookID})).Decode(&before); err != nil {
+			return err
+		}
+		// Copies on loan or on hold and the rating are not part of the
+		// history
+		for _, field := range []string{"on_loan", "on_hold", "rating", "review_count"} {
+			delete(restored, field)
+			if count, ok := before[field]; ok {
+				restored[field] = count
+			}
+		}
+		// A concurrent change aborts the transaction, so the book cannot
+		// change between reading and replacing it
+		if _, err := books.ReplaceOne(ctx, NotDeleted(bson.M{"id": bookID}), restored); err != nil {
+			return err
+		}
+		if err := WriteAudit(ctx, audit, NewAuditEntry(actor, AuditRevert, bookID, before, restored)); err != nil {
+			return err
+		}
+		if err := SaveRevision(ctx, revisions, actor, bookID, before, restored); err != nil {
+			return err
+		}
+		return Publish(ctx, outbox, BookUpdated, bookID, restored)
+	})
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Role grants access to a set of endpoints. Roles are ordered: every role
+// includes the permissions of the roles before it.
+//
+//	reader     read the catalog (GET)
+//	librarian  create and update books (POST, PUT)
+//	admin      delete books and bulk-import them
+type Role string
+
+const (
+	RoleReader    Role = "reader"
+	RoleLibrarian Role = "librarian"
+	RoleAdmin     Role = "admin"
+)
+
+// Roles lists every role, lowest first
+var Roles = []Role{RoleReader, RoleLibrarian, RoleAdmin}
+
+// ParseRoles converts role names given on the command line
+func ParseRoles(names []string) ([]Role, error) {
+	roles := make([]Role, 0, len(names))
+	for _, name := range names {
+		role := Role(name)
+		if !role.Valid() {
+			return nil, fmt.Errorf("unknown role %q", name)
+		}
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// Valid reports whether r is a known role
+func (r Role) Valid() bool {
+	return slices.Contains(Roles, r)
+}
+
+// Includes reports whether r grants the permissions of other
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && slices.Index(Roles, r) >= slices.Index(Roles, other)
+}
+
+// HasRole reports whether one of the principal's roles includes role
+func (p *Principal) HasRole(role Role) bool {
+	if p == nil {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r.Includes(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole only lets principals with the role (or a higher one) through.
+// It must run after the middleware authenticating the request: requests
+// without a principal are answered with 401, insufficient roles with 403.
+func RequireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			p := CurrentPrincipal(c)
+			if p == nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Missing credentials"})
+			}
+			if !p.HasRole(role) {
+				Logger(c).Info("Insufficient role", "required", role, "roles", p.Roles)
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "Requires role " + string(role)})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CSRFHeader carries the CSRF token of htmx requests. index.html sets it on
+// every request with hx-headers.
+const CSRFHeader = "X-CSRF-Token"
+
+// contentSecurityPolicy only allows resources served by the frontend itself:
+// htmx, the scripts and the stylesheets are self-hosted, and htmx is told not
+// to inject its indicator styles, so no inline code is needed
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self'; " +
+	"style-src 'self'; " +
+	"img-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// scripts are the self-hosted scripts index.html loads from /js
+var scripts = []string{"htmx.min.js", "sse.js"}
+
+// CheckScripts returns an error if a script index.html loads is missing in
+// dir. The CSP blocks CDNs, so without them the pages would not work.
+func CheckScripts(dir string) error {
+	for _, name := range scripts {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("%w, download it with: sh js/fetch.sh", err)
+		}
+	}
+	return nil
+}
+
+// SecurityHeaders sets the CSP and the usual hardening headers on every
+// response. HSTS is only sent over HTTPS, i.e., when the request is TLS or
+// nginx forwarded it with X-Forwarded-Proto: https.
+func SecurityHeaders() echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		ContentTypeNosniff:    "nosniff",
+		XFrameOptions:         "DENY",
+		HSTSMaxAge:            31536000,
+		ContentSecurityPolicy: contentSecurityPolicy,
+		ReferrerPolicy:        "same-origin",
+	})
+}
+
+// CSRF rejects state-changing requests of the frontend that do not carry the
+// token of the CSRF cookie, in the X-CSRF-Token header or the _csrf form
+// field. Token requests without a session are exempt: they authenticate with
+// the credentials in the body, which another site cannot know.
+func CSRF(secure bool) echo.MiddlewareFunc {
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper: func(c echo.Context) bool {
+			if c.Path() != "/auth/token" {
+				return false
+			}
+			_, err := c.Cookie(SessionCookie)
+			return err != nil
+		},
+		TokenLookup:    "header:" + CSRFHeader + ",form:_csrf",
+		CookieName:     "_csrf",
+		CookiePath:     "/",
+		CookieHTTPOnly: true,
+		CookieSecure:   secure,
+		CookieSameSite: http.SameSiteStrictMode,
+	})
+}
+
+// CSRFToken returns the token templates have to send back
+func CSRFToken(c echo.Context) string {
+	token, _ := c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	return token
+}
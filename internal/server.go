@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+)
+
+// NewServer creates the echo instance used by every service with the
+// middleware they all share already installed
+func NewServer(service string, logger *slog.Logger) *echo.Echo {
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+
+	// Continue the trace started by the caller (traceparent header) or start
+	// a new one; the request span is the parent of the MongoDB spans
+	e.Use(otelecho.Middleware(service, otelecho.WithSkipper(func(c echo.Context) bool {
+		return c.Path() == MetricsPath
+	})))
+	e.Use(requestID(logger))
+	e.Use(accessLog())
+	e.Use(metrics())
+
+	// Turn panics that slip through a handler into a logged 500 instead of
+	// crashing the whole service
+	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
+		LogErrorFunc: func(c echo.Context, err error, stack []byte) error {
+			Logger(c).Error("Recovered from panic", "error", err, "stack", string(stack))
+			return err
+		},
+	}))
+
+	e.GET(MetricsPath, echo.WrapHandler(promhttp.Handler()))
+
+	return e
+}
+
+// IPExtractor determines the client IP of a request. X-Forwarded-For is
+// only trusted on requests of the proxies in the given address ranges
+// (CIDR), as validated by config.Validate; everyone else is identified by
+// the address of the connection, so clients reaching a service directly
+// cannot pick their IP.
+func IPExtractor(trustedProxies []string) echo.IPExtractor {
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, cidr := range trustedProxies {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+			options = append(options, echo.TrustIPRange(ipNet))
+		}
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// Start runs the HTTP server until it fails or the process is asked to stop.
+// On SIGINT/SIGTERM in-flight requests are drained and Start returns, so the
+// deferred cleanup of the caller (flushing spans, disconnecting) still runs.
+func Start(e *echo.Echo, addr string) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		slog.Info("Listening", "addr", addr)
+		if err := e.Start(addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Fatal("Server stopped", err)
+		}
+	}()
+	<-ctx.Done()
+
+	slog.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		slog.Error("Failed to shut down gracefully", "error", err)
+	}
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SessionsCollection stores the sessions of signed-in users
+const SessionsCollection = "sessions"
+
+// SessionCookie is the name of the cookie holding the session token
+const SessionCookie = "session"
+
+// userKey stores the signed-in user in the echo context
+const userKey = "user"
+
+// Session links a random token, kept in a cookie by the browser, to a user.
+// Like API keys, only the hash of the token is stored.
+type Session struct {
+	Hash      string    `bson:"hash"`
+	Username  string    `bson:"username"`
+	CreatedAt time.Time `bson:"created_at"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// SessionStore manages the cookie based sessions of the web frontend
+type SessionStore struct {
+	coll    *mongo.Collection
+	users   *mongo.Collection
+	ttl     time.Duration
+	secure  bool
+	timeout time.Duration
+}
+
+// NewSessionStore prepares the sessions collection. MongoDB removes expired
+// sessions on its own through a TTL index. secure restricts the cookie to
+// HTTPS and should be enabled whenever the site is served over TLS.
+func NewSessionStore(ctx context.Context, db *mongo.Database, ttl time.Duration, secure bool, timeout time.Duration) (*SessionStore, error) {
+	coll := db.Collection(SessionsCollection)
+	_, err := coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &SessionStore{
+		coll:    coll,
+		users:   db.Collection(UsersCollection),
+		ttl:     ttl,
+		secure:  secure,
+		timeout: timeout,
+	}, nil
+}
+
+// Start signs the user in by creating a session and handing its token to
+// the browser
+func (s *SessionStore) Start(c echo.Context, username string) error {
+	token, err := randomString(32)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := QueryContext(c, s.timeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	_, err = s.coll.InsertOne(ctx, Session{
+		Hash:      hashToken(token),
+		Username:  username,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	c.SetCookie(s.cookie(token, int(s.ttl.Seconds())))
+	return nil
+}
+
+// End signs the user out, removing the session and its cookie
+func (s *SessionStore) End(c echo.Context) error {
+	cookie, err := c.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := QueryContext(c, s.timeout)
+	defer cancel()
+
+	if _, err := s.coll.DeleteOne(ctx, bson.M{"hash": hashToken(cookie.Value)}); err != nil {
+		return err
+	}
+	c.SetCookie(s.cookie("", -1))
+	return nil
+}
+
+// Middleware resolves the session cookie of every request and makes the user
+// the principal of the request, so RequireRole works in the frontend too.
+// Requests without a valid session are served anonymously.
+func (s *SessionStore) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cookie, err := c.Cookie(SessionCookie)
+			if err != nil || cookie.Value == "" {
+				return next(c)
+			}
+
+			ctx, cancel := QueryContext(c, s.timeout)
+			defer cancel()
+
+			var session Session
+			err = s.coll.FindOne(ctx, bson.M{
+				"hash":       hashToken(cookie.Value),
+				"expires_at": bson.M{"$gt": time.Now().UTC()},
+			}).Decode(&session)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return next(c)
+			}
+			if err != nil {
+				return DBError(c, err, "Failed to load session")
+			}
+
+			// Roles are read on every request, so changes apply immediately
+			user, err := FindUser(ctx, s.users, session.Username)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return next(c)
+			}
+			if err != nil {
+				return DBError(c, err, "Failed to load user")
+			}
+			c.Set(userKey, user.Username)
+			c.Set(principalKey, &Principal{Subject: user.Username, Roles: user.Roles})
+			c.Set(loggerKey, Logger(c).With("user", user.Username))
+			return next(c)
+		}
+	}
+}
+
+func (s *SessionStore) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// CurrentUser returns the name of the signed-in user, or "" for anonymous
+// visitors
+func CurrentUser(c echo.Context) string {
+	user, _ := c.Get(userKey).(string)
+	return user
+}
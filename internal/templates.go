@@ -19,7 +19,27 @@ func LoadTemplates() *Template {
 	}
 }
 
+// BookRow is the data of the "book-row" template. SwapOOB is set when the
+// row is sent as an out-of-band swap of a live update.
+type BookRow struct {
+	Book    map[string]interface{}
+	CanEdit bool
+	SwapOOB string
+}
+
+// BookRows prepares the rows of the "book-table" template
+func BookRows(books []map[string]interface{}, canEdit bool) []BookRow {
+	rows := make([]BookRow, len(books))
+	for i, book := range books {
+		rows[i] = BookRow{Book: book, CanEdit: canEdit}
+	}
+	return rows
+}
+
 // Render satisfies echo.Renderer interface
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
-	return t.tmpl.ExecuteTemplate(w, name, data)
+	_, span := tracer.Start(c.Request().Context(), "render "+name)
+	err := t.tmpl.ExecuteTemplate(w, name, data)
+	endSpan(span, err)
+	return err
 }
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// TokenIssuer is the "iss" claim of every token signed by the frontend
+const TokenIssuer = "bookstore"
+
+// JWKSPath is where the frontend publishes the public signing keys
+const JWKSPath = "/.well-known/jwks.json"
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the contents of an access token
+type Claims struct {
+	jwt.StandardClaims
+	Roles []Role `json:"roles"`
+}
+
+// signingKey is an RSA key together with its key ID ("kid")
+type signingKey struct {
+	id  string
+	key *rsa.PrivateKey
+}
+
+// TokenSigner issues the access tokens. Tokens are signed with the shared
+// secret (HS256) if one is configured, otherwise with the first RSA key
+// (RS256). Every RSA key is published in the JWKS, so keys can be rotated by
+// adding a new first key and dropping the old one once its tokens expired.
+type TokenSigner struct {
+	secret []byte
+	keys   []signingKey
+	ttl    time.Duration
+}
+
+// NewTokenSigner loads the PEM encoded RSA keys. Without a secret and without
+// keys an ephemeral key is generated: its tokens stop being valid when the
+// service restarts.
+func NewTokenSigner(secret string, keyFiles []string, ttl time.Duration) (*TokenSigner, error) {
+	s := &TokenSigner{secret: []byte(secret), ttl: ttl}
+
+	for _, file := range keyFiles {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		s.keys = append(s.keys, signingKey{id: keyID(&key.PublicKey), key: key})
+	}
+
+	if secret == "" && len(s.keys) == 0 {
+		slog.Warn("No JWT signing key configured, generating an ephemeral one")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, signingKey{id: keyID(&key.PublicKey), key: key})
+	}
+	return s, nil
+}
+
+// Sign issues a token for the user
+func (s *TokenSigner) Sign(username string, roles []Role) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(s.ttl)
+	claims := Claims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    TokenIssuer,
+			Subject:   username,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expires.Unix(),
+		},
+		Roles: roles,
+	}
+
+	if len(s.secret) > 0 {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+		return token, expires, err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keys[0].id
+	signed, err := token.SignedString(s.keys[0].key)
+	return signed, expires, err
+}
+
+// JWK is the JSON Web Key representation of an RSA public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is the document served on JWKSPath
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of the signing keys
+func (s *TokenSigner) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range s.keys {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Kid: k.id,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(k.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.key.E)).Bytes()),
+		})
+	}
+	return set
+}
+
+// TokenVerifier checks access tokens locally, with the shared secret or the
+// keys fetched from the issuer's JWKS. Unknown key IDs trigger a refresh of
+// the JWKS, so rotated keys are picked up without a restart.
+type TokenVerifier struct {
+	secret  []byte
+	jwksURL string
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// jwksRefreshInterval limits how often the JWKS is downloaded
+const jwksRefreshInterval = 30 * time.Second
+
+// NewTokenVerifier returns nil when neither a secret nor a JWKS URL is
+// configured, i.e., when the service does not accept tokens at all
+func NewTokenVerifier(secret, jwksURL string) *TokenVerifier {
+	if secret == "" && jwksURL == "" {
+		return nil
+	}
+	return &TokenVerifier{
+		secret:  []byte(secret),
+		jwksURL: jwksURL,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		keys:    map[string]*rsa.PublicKey{},
+	}
+}
+
+// Verify parses the token and checks its signature, issuer and expiry
+func (v *TokenVerifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	var methods []string
+	if len(v.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if v.jwksURL != "" {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	parser := &jwt.Parser{ValidMethods: methods}
+
+	var claims Claims
+	_, err := parser.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); ok {
+			return v.secret, nil
+		}
+		kid, _ := t.Header["kid"].(string)
+		return v.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.ExpiresAt == 0 || !claims.VerifyIssuer(TokenIssuer, true) {
+		return nil, fmt.Errorf("%w: missing expiry or wrong issuer", ErrInvalidToken)
+	}
+	return &claims, nil
+}
+
+func (v *TokenVerifier) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	v.fetchedAt = time.Now()
+	keys, err := v.fetchJWKS(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (v *TokenVerifier) fetchJWKS(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decoding JWKS key %q: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decoding JWKS key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// keyID derives a stable key ID from the public key
+func keyID(key *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(key)
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported values of config.Config.TracingExporter
+const (
+	TracingNone   = "none"
+	TracingStdout = "stdout"
+	TracingOTLP   = "otlp"
+)
+
+// tracer creates the spans that are not produced by an instrumentation
+// library, e.g., template rendering
+var tracer = otel.Tracer("github.com/CAPS-Cloud/exercises/internal")
+
+// InitTracing installs the global tracer provider of a service and the W3C
+// trace context propagator, so a traceparent header set by nginx (or any
+// other caller) continues the same trace. The OTLP exporter is configured
+// through the standard OTEL_EXPORTER_OTLP_* environment variables.
+//
+// The returned function flushes pending spans and must be called before the
+// service exits.
+func InitTracing(ctx context.Context, service, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch exporter {
+	case TracingNone, "":
+		return func(context.Context) error { return nil }, nil
+	case TracingStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case TracingOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		err = fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider, err := installTracerProvider(service, exp)
+	if err != nil {
+		return nil, err
+	}
+	return provider.Shutdown, nil
+}
+
+// installTracerProvider makes a provider exporting the spans of the service
+// through exp the global one
+func installTracerProvider(service string, exp sdktrace.SpanExporter) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(service),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
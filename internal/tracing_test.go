@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingSpanPerRequest(t *testing.T) {
+	// InitTracing installs the propagator, the spans are then exported to
+	// memory instead of stdout or a collector
+	if _, err := InitTracing(context.Background(), "tracing-test", TracingNone); err != nil {
+		t.Fatal(err)
+	}
+	previous := otel.GetTracerProvider()
+	exp := tracetest.NewInMemoryExporter()
+	provider, err := installTracerProvider("tracing-test", exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otel.SetTracerProvider(previous)
+	defer provider.Shutdown(context.Background())
+
+	e := NewServer("tracing-test", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	e.GET("/tracing-test/books/:id", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	// One request with the ID and trace context nginx sends, one without
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	forwarded := httptest.NewRequest(http.MethodGet, "/tracing-test/books/b1", nil)
+	forwarded.Header.Set(echo.HeaderXRequestID, "req-from-nginx")
+	forwarded.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	direct := httptest.NewRequest(http.MethodGet, "/tracing-test/books/b2", nil)
+
+	var requestIDs []string
+	for _, req := range []*http.Request{forwarded, direct} {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		requestIDs = append(requestIDs, rec.Header().Get(echo.HeaderXRequestID))
+	}
+	// Metrics scrapes are not traced
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+
+	// The exporter forgets its spans on shutdown, so only flush them
+	if err := provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want one per request: %v", len(spans), spans.Snapshots())
+	}
+
+	for i, span := range spans {
+		if span.Name != "/tracing-test/books/:id" {
+			t.Errorf("span %d is named %q, want the route", i, span.Name)
+		}
+		var got string
+		for _, attr := range span.Attributes {
+			if attr.Key == RequestIDAttribute {
+				got = attr.Value.AsString()
+			}
+		}
+		if got == "" || got != requestIDs[i] {
+			t.Errorf("span %d has request ID %q, want %q", i, got, requestIDs[i])
+		}
+	}
+	if requestIDs[0] != "req-from-nginx" {
+		t.Errorf("request ID %q of nginx not reused", requestIDs[0])
+	}
+	if got := spans[0].SpanContext.TraceID().String(); got != traceID {
+		t.Errorf("span continues trace %s, want %s of the traceparent header", got, traceID)
+	}
+}
+
+func TestInitTracingUnknownExporter(t *testing.T) {
+	if _, err := InitTracing(context.Background(), "tracing-test", "zipkin"); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}
@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Audit actions of the trash bin
+const (
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+)
+
+// PurgeActor is the actor of the audit entries written by the purge
+const PurgeActor = "system:purge"
+
+// purgeInterval is how often the trash is checked for expired books
+const purgeInterval = time.Hour
+
+// TrashedBook is a deleted book in the trash listing
+type TrashedBook struct {
+	BookStore `bson:",inline"`
+	DeletedAt time.Time `bson:"deleted_at" json:"deleted_at"`
+	DeletedBy string    `bson:"deleted_by" json:"deleted_by"`
+	// PurgeAt is when the book is removed for good
+	PurgeAt time.Time `bson:"-" json:"purge_at"`
+}
+
+// NotDeleted restricts a filter to the books that are not in the trash.
+// Deleted books keep their document with a deleted_at date until they are
+// purged.
+func NotDeleted(filter bson.M) bson.M {
+	filter["deleted_at"] = bson.M{"$exists": false}
+	return filter
+}
+
+// TrashBook moves a book to the trash and publishes its deletion through the
+// outbox. It returns mongo.ErrNoDocuments if the book does not exist or is
+// already deleted.
+func TrashBook(ctx context.Context, books, audit, outbox *mongo.Collection, actor Actor, bookID string) error {
+	return WithTransaction(ctx, books.Database().Client(), func(ctx mongo.SessionContext) error {
+		var after bson.M
+		err := books.FindOneAndUpdate(ctx,
+			NotDeleted(bson.M{"id": bookID}),
+			bson.M{"$set": bson.M{"deleted_at": time.Now().UTC(), "deleted_by": actor.Subject}},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&after)
+		if err != nil {
+			return err
+		}
+
+		before := bson.M{}
+		for field, value := range after {
+			if field != "deleted_at" && field != "deleted_by" {
+				before[field] = value
+			}
+		}
+		if err := WriteAudit(ctx, audit, NewAuditEntry(actor, AuditDelete, bookID, before, after)); err != nil {
+			return err
+		}
+		return Publish(ctx, outbox, BookDeleted, bookID, nil)
+	})
+}
+
+// RestoreBook takes a book out of the trash and publishes it as created
+// through the outbox. It returns mongo.ErrNoDocuments if the book is not in
+// the trash.
+func RestoreBook(ctx context.Context, books, audit, outbox *mongo.Collection, actor Actor, bookID string) error {
+	return WithTransaction(ctx, books.Database().Client(), func(ctx mongo.SessionContext) error {
+		var before bson.M
+		err := books.FindOneAndUpdate(ctx,
+			bson.M{"id": bookID, "deleted_at": bson.M{"$exists": true}},
+			bson.M{"$unset": bson.M{"deleted_at": "", "deleted_by": ""}},
+		).Decode(&before)
+		if err != nil {
+			return err
+		}
+
+		after := bson.M{}
+		for field, value := range before {
+			if field != "deleted_at" && field != "deleted_by" {
+				after[field] = value
+			}
+		}
+		if err := WriteAudit(ctx, audit, NewAuditEntry(actor, AuditRestore, bookID, before, after)); err != nil {
+			return err
+		}
+		return Publish(ctx, outbox, BookCreated, bookID, after)
+	})
+}
+
+// ListTrash returns the deleted books, most recently deleted first
+func ListTrash(ctx context.Context, coll *mongo.Collection, retention time.Duration) ([]TrashedBook, error) {
+	cursor, err := coll.Find(ctx, bson.M{"deleted_at": bson.M{"$exists": true}},
+		options.Find().SetSort(bson.D{{Key: "deleted_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	books := []TrashedBook{}
+	if err = cursor.All(ctx, &books); err != nil {
+		return nil, err
+	}
+	for i := range books {
+		books[i].PurgeAt = books[i].DeletedAt.Add(retention)
+	}
+	return books, nil
+}
+
+// PurgeTrash permanently removes the books deleted before cutoff together
+// with their revisions and reviews, and cancels their active holds. Books
+// with copies still on loan are kept until they are returned. The audit log
+// keeps a record of each purged book.
+func PurgeTrash(ctx context.Context, books, revisions, audit, holds, reviews *mongo.Collection, cutoff time.Time) (int64, error) {
+	expired := bson.M{"deleted_at": bson.M{"$lt": cutoff}, "on_loan": bson.M{"$not": bson.M{"$gt": 0}}}
+	cursor, err := books.Find(ctx, expired)
+	if err != nil {
+		return 0, err
+	}
+	var docs []bson.M
+	if err = cursor.All(ctx, &docs); err != nil {
+		return 0, err
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]interface{}, len(docs))
+	entries := make([]AuditEntry, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc["id"]
+		id, _ := doc["id"].(string)
+		entries[i] = AuditEntry{
+			Time:    time.Now().UTC(),
+			Action:  AuditPurge,
+			BookID:  id,
+			Actor:   PurgeActor,
+			Changes: diffBooks(doc, nil),
+		}
+	}
+
+	var deleted int64
+	err = WithTransaction(ctx, books.Database().Client(), func(ctx mongo.SessionContext) error {
+		expired["id"] = bson.M{"$in": ids}
+		result, err := books.DeleteMany(ctx, expired)
+		if err != nil {
+			return err
+		}
+		deleted = result.DeletedCount
+
+		byBook := bson.M{"book_id": bson.M{"$in": ids}}
+		if _, err := revisions.DeleteMany(ctx, byBook); err != nil {
+			return err
+		}
+		if _, err := reviews.DeleteMany(ctx, byBook); err != nil {
+			return err
+		}
+		// A purged book cannot be restored, so its holds would wait forever
+		_, err = holds.UpdateMany(ctx,
+			bson.M{"book_id": bson.M{"$in": ids}, "active": true},
+			bson.M{
+				"$set":   bson.M{"status": HoldCancelled, "active": false, "closed_at": time.Now().UTC()},
+				"$unset": bson.M{"expires_at": ""},
+			},
+		)
+		if err != nil {
+			return err
+		}
+		return WriteAudit(ctx, audit, entries...)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// StartPurger purges books that have been in the trash for longer than
+// retention, once at start and then every hour, until ctx is done
+func StartPurger(ctx context.Context, books, revisions, audit, holds, reviews *mongo.Collection, retention, timeout time.Duration) {
+	purge := func() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		n, err := PurgeTrash(ctx, books, revisions, audit, holds, reviews, time.Now().Add(-retention))
+		if err != nil {
+			slog.Error("Failed to purge trash", "error", err)
+			return
+		}
+		if n > 0 {
+			slog.Info("Purged trash", "books", n)
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+
+		purge()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				purge()
+			}
+		}
+	}()
+}
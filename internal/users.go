@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UsersCollection stores the accounts of the web frontend
+const UsersCollection = "users"
+
+// MinPasswordLength is the shortest password accepted on registration
+const MinPasswordLength = 8
+
+// MaxPasswordLength is the longest password in bytes accepted on
+// registration, bcrypt refuses to hash longer ones
+const MaxPasswordLength = 72
+
+// DefaultUserRoles are the roles of a newly registered user. Admins grant
+// further roles with cmd/user.
+var DefaultUserRoles = []Role{RoleReader}
+
+var (
+	ErrUserExists         = errors.New("username already taken")
+	ErrInvalidUsername    = errors.New("username must be 3 to 32 letters, digits, '.', '-' or '_'")
+	ErrUsernameReserved   = errors.New("username is reserved")
+	ErrPasswordTooShort   = errors.New("password must be at least 8 characters long")
+	ErrPasswordTooLong    = errors.New("password must be at most 72 bytes long")
+	ErrInvalidCredentials = errors.New("invalid username or password")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]{3,32}$`)
+
+// dummyHash is compared against when the user does not exist, so a login
+// takes as long for unknown users as for wrong passwords
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// User is an account of the web frontend. Only the bcrypt hash of the
+// password is stored.
+type User struct {
+	Username     string    `bson:"username" json:"username"`
+	PasswordHash []byte    `bson:"password_hash" json:"-"`
+	Roles        []Role    `bson:"roles" json:"roles"`
+	CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+}
+
+// PrepareUsers returns the users collection, making sure usernames are unique
+func PrepareUsers(ctx context.Context, db *mongo.Database) (*mongo.Collection, error) {
+	coll := db.Collection(UsersCollection)
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "username", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return coll, nil
+}
+
+// RegisterUser creates a new account
+func RegisterUser(ctx context.Context, coll *mongo.Collection, username, password string) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, ErrInvalidUsername
+	}
+	// Anonymous requests are attributed to AnonymousSubject, e.g. in the
+	// audit log, so no account may take its name
+	if strings.EqualFold(username, AnonymousSubject) {
+		return nil, ErrUsernameReserved
+	}
+	if len(password) < MinPasswordLength {
+		return nil, ErrPasswordTooShort
+	}
+	if len(password) > MaxPasswordLength {
+		return nil, ErrPasswordTooLong
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		Username:     username,
+		PasswordHash: hash,
+		Roles:        DefaultUserRoles,
+		CreatedAt:    time.Now().UTC(),
+	}
+	if _, err := coll.InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrUserExists
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// AuthenticateUser checks the password of a user
+func AuthenticateUser(ctx context.Context, coll *mongo.Collection, username, password string) (*User, error) {
+	var user User
+	err := coll.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+// SetUserRoles replaces the roles of a user
+func SetUserRoles(ctx context.Context, coll *mongo.Collection, username string, roles []Role) error {
+	result, err := coll.UpdateOne(ctx, bson.M{"username": username}, bson.M{"$set": bson.M{"roles": roles}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ListUsers returns every account
+func ListUsers(ctx context.Context, coll *mongo.Collection) ([]User, error) {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "username", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// FindUser loads the account of a signed-in user
+func FindUser(ctx context.Context, coll *mongo.Collection, username string) (*User, error) {
+	var user User
+	if err := coll.FindOne(ctx, bson.M{"username": username}).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRegisterUserValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name, username, password string
+		want                     error
+	}{
+		{"short username", "al", "correct horse", ErrInvalidUsername},
+		{"username with spaces", "alice smith", "correct horse", ErrInvalidUsername},
+		{"reserved username", AnonymousSubject, "correct horse", ErrUsernameReserved},
+		{"reserved username in capitals", "Anonymous", "correct horse", ErrUsernameReserved},
+		{"short password", "alice", "secret", ErrPasswordTooShort},
+		{"password over 72 bytes", "alice", strings.Repeat("a", 73), ErrPasswordTooLong},
+		{"multi-byte password over 72 bytes", "alice", strings.Repeat("ä", 37), ErrPasswordTooLong},
+	} {
+		// Invalid input is refused before the collection is touched
+		if _, err := RegisterUser(context.Background(), nil, tc.username, tc.password); !errors.Is(err, tc.want) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Collections of the webhook subscriptions and their delivery queue
+const (
+	WebhooksCollection   = "webhooks"
+	DeliveriesCollection = "webhook_deliveries"
+)
+
+// Headers of a webhook request. The signature is the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" with the secret of the webhook. The
+// delivery ID stays the same across retries and serves receivers as
+// idempotency key, as does the event ID in the body.
+const (
+	WebhookEventHeader     = "X-Bookstore-Event"
+	WebhookDeliveryHeader  = "X-Bookstore-Delivery"
+	WebhookTimestampHeader = "X-Bookstore-Timestamp"
+	WebhookSignatureHeader = "X-Bookstore-Signature"
+)
+
+// Delivery states
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// maxDeliveryAttempts is how often a delivery is tried before it fails
+	maxDeliveryAttempts = 8
+	// First retry after 10s, doubling up to an hour
+	deliveryBackoff    = 10 * time.Second
+	maxDeliveryBackoff = time.Hour
+	// deliveryLease is how long a worker owns a delivery it is sending
+	deliveryLease = time.Minute
+	// deliveryPollInterval is how often the queue is checked when it is empty
+	deliveryPollInterval = 2 * time.Second
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+)
+
+// EventTypes lists every event a webhook can subscribe to
+var EventTypes = []EventType{BookCreated, BookUpdated, BookDeleted}
+
+// Webhook is a subscription of a downstream system. Events filters the
+// events sent to it, an empty list subscribes to all of them.
+type Webhook struct {
+	ID        string      `bson:"id" json:"id"`
+	URL       string      `bson:"url" json:"url"`
+	Events    []EventType `bson:"events" json:"events"`
+	Secret    string      `bson:"secret" json:"-"`
+	CreatedBy string      `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+}
+
+// Delivery is an event queued for a webhook, with the log of its attempts
+type Delivery struct {
+	ID            string            `bson:"id" json:"id"`
+	WebhookID     string            `bson:"webhook_id" json:"webhook_id"`
+	Event         BookEvent         `bson:"event" json:"event"`
+	Status        string            `bson:"status" json:"status"`
+	Attempts      []DeliveryAttempt `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time         `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   time.Time         `bson:"locked_until" json:"-"`
+	CreatedAt     time.Time         `bson:"created_at" json:"created_at"`
+}
+
+// DeliveryAttempt is one request sent to a webhook
+type DeliveryAttempt struct {
+	Time       time.Time     `bson:"time" json:"time"`
+	StatusCode int           `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   time.Duration `bson:"duration" json:"duration"`
+}
+
+// PrepareWebhooks returns the webhook and delivery collections
+func PrepareWebhooks(ctx context.Context, db *mongo.Database) (*mongo.Collection, *mongo.Collection, error) {
+	webhooks := db.Collection(WebhooksCollection)
+	_, err := webhooks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deliveries := db.Collection(DeliveriesCollection)
+	_, err = deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return webhooks, deliveries, nil
+}
+
+// RegisterWebhook subscribes url to the given events. The secret of the
+// returned webhook signs the payloads and is only shown on registration.
+func RegisterWebhook(ctx context.Context, coll *mongo.Collection, rawURL string, events []EventType, createdBy string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: url must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+	for _, ev := range events {
+		if !slices.Contains(EventTypes, ev) {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, ev)
+		}
+	}
+	if events == nil {
+		events = []EventType{}
+	}
+
+	id, err := randomString(6)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	hook := &Webhook{
+		ID:        id,
+		URL:       u.String(),
+		Events:    events,
+		Secret:    secret,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := coll.InsertOne(ctx, hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// ListWebhooks returns every subscription
+func ListWebhooks(ctx context.Context, coll *mongo.Collection) ([]Webhook, error) {
+	cursor, err := coll.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	if err = cursor.All(ctx, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook removes a subscription. Its pending deliveries are dropped.
+func DeleteWebhook(ctx context.Context, webhooks, deliveries *mongo.Collection, id string) error {
+	result, err := webhooks.DeleteOne(ctx, bson.M{"id": id})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	_, err = deliveries.UpdateMany(ctx,
+		bson.M{"webhook_id": id, "status": DeliveryPending},
+		bson.M{"$set": bson.M{"status": DeliveryFailed}},
+	)
+	return err
+}
+
+// ListDeliveries returns the most recent deliveries of a webhook
+func ListDeliveries(ctx context.Context, coll *mongo.Collection, webhookID string, limit int64) ([]Delivery, error) {
+	cursor, err := coll.Find(ctx, bson.M{"webhook_id": webhookID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	list := []Delivery{}
+	if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// EnqueueDeliveries queues the event for every webhook subscribed to it. The
+// delivery IDs derive from the event ID, so queueing an event again does not
+// create duplicate deliveries.
+func EnqueueDeliveries(ctx context.Context, webhooks, deliveries *mongo.Collection, ev BookEvent) error {
+	hooks, err := ListWebhooks(ctx, webhooks)
+	if err != nil {
+		return err
+	}
+
+	var docs []interface{}
+	now := time.Now().UTC()
+	for _, hook := range hooks {
+		if len(hook.Events) > 0 && !slices.Contains(hook.Events, ev.Type) {
+			continue
+		}
+		docs = append(docs, Delivery{
+			ID:            ev.ID + "." + hook.ID,
+			WebhookID:     hook.ID,
+			Event:         ev,
+			Status:        DeliveryPending,
+			Attempts:      []DeliveryAttempt{},
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	_, err = deliveries.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if isOnlyDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// isOnlyDuplicateKeyError reports whether every failed write of a bulk
+// insert failed because the document already exists
+func isOnlyDuplicateKeyError(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// RunDeliveries sends the queued deliveries until ctx is done. Several
+// workers may run at once: each delivery is leased by the worker sending it.
+func RunDeliveries(ctx context.Context, webhooks, deliveries *mongo.Collection, client *http.Client) {
+	for {
+		sent, err := deliverNext(ctx, webhooks, deliveries, client)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("Failed to process webhook delivery", "error", err)
+		}
+		if sent {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(deliveryPollInterval):
+		}
+	}
+}
+
+// deliverNext leases the next due delivery and sends it. It returns false if
+// the queue had nothing to send.
+func deliverNext(ctx context.Context, webhooks, deliveries *mongo.Collection, client *http.Client) (bool, error) {
+	now := time.Now().UTC()
+	var d Delivery
+	err := deliveries.FindOneAndUpdate(ctx,
+		bson.M{
+			"status":          DeliveryPending,
+			"next_attempt_at": bson.M{"$lte": now},
+			"locked_until":    bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"locked_until": now.Add(deliveryLease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}),
+	).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var hook Webhook
+	err = webhooks.FindOne(ctx, bson.M{"id": d.WebhookID}).Decode(&hook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		_, err = deliveries.UpdateOne(ctx, bson.M{"id": d.ID}, bson.M{"$set": bson.M{"status": DeliveryFailed}})
+		return true, err
+	}
+	if err != nil {
+		return true, err
+	}
+
+	attempt := SendWebhook(ctx, client, &hook, &d)
+	attempts := len(d.Attempts) + 1
+
+	update := bson.M{"locked_until": time.Time{}}
+	switch {
+	case attempt.Error == "":
+		update["status"] = DeliveryDelivered
+	case attempts >= maxDeliveryAttempts:
+		update["status"] = DeliveryFailed
+	default:
+		update["next_attempt_at"] = time.Now().UTC().Add(retryBackoff(attempts))
+	}
+	_, err = deliveries.UpdateOne(ctx, bson.M{"id": d.ID}, bson.M{
+		"$set":  update,
+		"$push": bson.M{"attempts": attempt},
+	})
+	if attempt.Error != "" {
+		slog.Warn("Webhook delivery failed", "webhook_id", hook.ID, "delivery_id", d.ID, "attempt", attempts, "error", attempt.Error)
+	}
+	return true, err
+}
+
+// retryBackoff is the delay before the next attempt after n failed ones
+func retryBackoff(n int) time.Duration {
+	backoff := deliveryBackoff << (n - 1)
+	if backoff <= 0 || backoff > maxDeliveryBackoff {
+		return maxDeliveryBackoff
+	}
+	return backoff
+}
+
+// SendWebhook posts the event of the delivery to the webhook. Any response
+// other than 2xx counts as a failure.
+func SendWebhook(ctx context.Context, client *http.Client, hook *Webhook, d *Delivery) DeliveryAttempt {
+	start := time.Now()
+	attempt := DeliveryAttempt{Time: start.UTC()}
+
+	body, err := json.Marshal(d.Event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bookstore-webhooks/1")
+	req.Header.Set(WebhookEventHeader, string(d.Event.Type))
+	req.Header.Set(WebhookDeliveryHeader, d.ID)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhook(hook.Secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	attempt.Duration = time.Since(start)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = resp.Status
+	}
+	return attempt
+}
+
+// SignWebhook returns the signature receivers recompute to check a payload
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
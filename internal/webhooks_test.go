@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const testWebhookSecret = "whsec_test"
+
+// receiver is a webhook endpoint answering with the given status codes in
+// turn and recording the requests it got
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		status := r.statuses[len(r.requests)%len(r.statuses)]
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func testDelivery(hookID string, attempts int) *Delivery {
+	d := &Delivery{
+		ID:        "ev1." + hookID,
+		WebhookID: hookID,
+		Event:     BookEvent{ID: "ev1", Type: BookUpdated, BookID: "b1", Time: time.Now().UTC()},
+		Status:    DeliveryPending,
+		Attempts:  []DeliveryAttempt{},
+	}
+	for i := 0; i < attempts; i++ {
+		d.Attempts = append(d.Attempts, DeliveryAttempt{StatusCode: http.StatusInternalServerError})
+	}
+	return d
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	r := newReceiver(t, http.StatusNoContent)
+	hook := &Webhook{ID: "h1", URL: r.URL, Secret: testWebhookSecret}
+	d := testDelivery(hook.ID, 0)
+
+	attempt := SendWebhook(context.Background(), r.Client(), hook, d)
+	if attempt.Error != "" || attempt.StatusCode != http.StatusNoContent {
+		t.Fatalf("attempt failed: %+v", attempt)
+	}
+
+	// The receiver recomputes the HMAC over "<timestamp>.<body>"
+	req, body := r.requests[0], r.bodies[0]
+	timestamp := req.Header.Get(WebhookTimestampHeader)
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get(WebhookSignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if sig := SignWebhook("other-secret", timestamp, body); "sha256="+sig == want {
+		t.Error("signature does not depend on the secret")
+	}
+	if sig := SignWebhook(testWebhookSecret, timestamp+"0", body); "sha256="+sig == want {
+		t.Error("signature does not cover the timestamp")
+	}
+
+	var ev BookEvent
+	if err := json.Unmarshal(body, &ev); err != nil || ev.ID != d.Event.ID {
+		t.Errorf("body %s is not event %s: %v", body, d.Event.ID, err)
+	}
+	if got := req.Header.Get(WebhookEventHeader); got != string(BookUpdated) {
+		t.Errorf("event header %q, want %q", got, BookUpdated)
+	}
+}
+
+func TestSendWebhookRetryKeepsDeliveryID(t *testing.T) {
+	r := newReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+	hook := &Webhook{ID: "h1", URL: r.URL, Secret: testWebhookSecret}
+	d := testDelivery(hook.ID, 0)
+
+	first := SendWebhook(context.Background(), r.Client(), hook, d)
+	if first.Error == "" || first.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("5xx counted as delivered: %+v", first)
+	}
+	if retry := SendWebhook(context.Background(), r.Client(), hook, d); retry.Error != "" {
+		t.Errorf("retry failed: %+v", retry)
+	}
+
+	for i, req := range r.requests {
+		if got := req.Header.Get(WebhookDeliveryHeader); got != d.ID {
+			t.Errorf("attempt %d has delivery ID %q, want %q", i+1, got, d.ID)
+		}
+	}
+}
+
+func TestEnqueueDeliveriesIsIdempotent(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("enqueue twice", func(mt *mtest.T) {
+		hooks := mtest.CreateCursorResponse(0, "test.webhooks", mtest.FirstBatch,
+			bson.D{{Key: "id", Value: "h1"}, {Key: "events", Value: bson.A{}}})
+		ev := BookEvent{ID: "ev1", Type: BookCreated, BookID: "b1"}
+
+		mt.AddMockResponses(hooks, mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}))
+		if err := EnqueueDeliveries(context.Background(), mt.Coll, mt.Coll, ev); err != nil {
+			t.Fatal(err)
+		}
+		// The relay handing the event over again finds the delivery stored
+		mt.AddMockResponses(hooks, mtest.CreateWriteErrorsResponse(mtest.WriteError{Code: 11000, Message: "duplicate key"}))
+		if err := EnqueueDeliveries(context.Background(), mt.Coll, mt.Coll, ev); err != nil {
+			t.Errorf("repeated event: %v", err)
+		}
+
+		var ids []string
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName == "insert" {
+				ids = append(ids, started.Command.Lookup("documents", "0", "id").StringValue())
+			}
+		}
+		if len(ids) != 2 || ids[0] != "ev1.h1" || ids[1] != ids[0] {
+			t.Errorf("delivery IDs %v, want ev1.h1 both times", ids)
+		}
+	})
+}
+
+// deliverOnce runs deliverNext for a delivery that failed attempts times,
+// answered by the receiver with status, and returns the update stored
+func deliverOnce(mt *mtest.T, attempts, status int) (bson.Raw, *receiver) {
+	r := newReceiver(mt.T, status)
+	hook := Webhook{ID: "h1", URL: r.URL, Secret: testWebhookSecret}
+	mt.AddMockResponses(
+		mtest.CreateSuccessResponse(bson.E{Key: "value", Value: testDelivery(hook.ID, attempts)}),
+		mtest.CreateCursorResponse(0, "test.webhooks", mtest.FirstBatch, mustMarshal(mt, hook)),
+		mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+	)
+
+	sent, err := deliverNext(context.Background(), mt.Coll, mt.Coll, r.Client())
+	if err != nil || !sent {
+		mt.Fatalf("deliverNext: sent %v, %v", sent, err)
+	}
+	for _, started := range mt.GetAllStartedEvents() {
+		if started.CommandName == "update" {
+			return started.Command.Lookup("updates", "0", "u").Document(), r
+		}
+	}
+	mt.Fatal("delivery not updated")
+	return nil, nil
+}
+
+func mustMarshal(mt *mtest.T, v interface{}) bson.D {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		mt.Fatal(err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		mt.Fatal(err)
+	}
+	return doc
+}
+
+func TestDeliverNextBacksOffAfter5xx(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		backoff  time.Duration
+	}{
+		{"first failure", 0, 10 * time.Second},
+		{"second failure", 1, 20 * time.Second},
+		{"fourth failure", 3, 80 * time.Second},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			// Dates are stored in milliseconds
+			start := time.Now().Truncate(time.Millisecond)
+			update, r := deliverOnce(mt, tc.attempts, http.StatusBadGateway)
+			if len(r.requests) != 1 {
+				mt.Fatalf("receiver got %d requests, want 1", len(r.requests))
+			}
+
+			set := update.Lookup("$set").Document()
+			if _, err := set.LookupErr("status"); err == nil {
+				mt.Errorf("status changed to %s, want the delivery kept pending", set.Lookup("status"))
+			}
+			next := set.Lookup("next_attempt_at").Time()
+			if delay := next.Sub(start); delay < tc.backoff || delay > tc.backoff+5*time.Second {
+				mt.Errorf("next attempt after %s, want %s", delay, tc.backoff)
+			}
+			if code := update.Lookup("$push", "attempts", "status_code").Int32(); code != http.StatusBadGateway {
+				mt.Errorf("attempt logged with status %d, want %d", code, http.StatusBadGateway)
+			}
+		})
+	}
+}
+
+func TestDeliverNextGivesUpAfterMaxAttempts(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tc := range []struct {
+		name     string
+		attempts int
+		status   string
+	}{
+		{"seventh attempt", maxDeliveryAttempts - 2, ""},
+		{"eighth attempt", maxDeliveryAttempts - 1, DeliveryFailed},
+	} {
+		mt.Run(tc.name, func(mt *mtest.T) {
+			update, _ := deliverOnce(mt, tc.attempts, http.StatusInternalServerError)
+
+			set := update.Lookup("$set").Document()
+			status, _ := set.Lookup("status").StringValueOK()
+			if status != tc.status {
+				mt.Errorf("status %q after %d attempts, want %q", status, tc.attempts+1, tc.status)
+			}
+			_, err := set.LookupErr("next_attempt_at")
+			if tc.status == DeliveryFailed && err == nil {
+				mt.Error("failed delivery scheduled again")
+			}
+		})
+	}
+	if maxDeliveryAttempts != 8 {
+		t.Errorf("deliveries are given up after %d attempts, want 8", maxDeliveryAttempts)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{5, 160 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	} {
+		if got := retryBackoff(tc.failures); got != tc.want {
+			t.Errorf("retryBackoff(%d) = %s, want %s", tc.failures, got, tc.want)
+		}
+	}
+}
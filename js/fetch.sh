@@ -0,0 +1,20 @@
+#!/bin/sh
+# Downloads the htmx scripts index.html loads from /js, pinned to the htmx
+# version below. Files already in js/ are kept, so once they are committed
+# builds do not download anything. Run from the repository root:
+#
+#   sh js/fetch.sh
+set -eu
+
+HTMX_VERSION=1.9.12
+BASE=https://unpkg.com/htmx.org@$HTMX_VERSION/dist
+DIR=$(dirname "$0")
+
+fetch() {
+	if [ ! -s "$DIR/$2" ]; then
+		curl -fsSL -o "$DIR/$2" "$BASE/$1"
+	fi
+}
+
+fetch htmx.min.js htmx.min.js
+fetch ext/sse.js sse.js
@@ -0,0 +1,13 @@
+document.addEventListener("DOMContentLoaded", (event) => {
+  document.body.addEventListener('htmx:beforeSwap', function (evt) {
+    if (evt.detail.xhr.status === 422 || evt.detail.xhr.status === 400) {
+      // allow 422 and 400 responses to swap as we are using them as a
+      // signal that a form was submitted with bad data and want to rerender
+      // with the errors
+      //
+      // set isError to false to avoid error logging in console
+      evt.detail.shouldSwap = true;
+      evt.detail.isError = false;
+    }
+  });
+})